@@ -2,15 +2,20 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/bopoh24/bazacars/internal/bot"
 	"github.com/bopoh24/bazacars/internal/config"
 	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/parser"
 	"github.com/bopoh24/bazacars/internal/repository/postgres"
 	"github.com/bopoh24/bazacars/internal/service"
 	"github.com/robfig/cron/v3"
+	"html"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -25,13 +30,41 @@ const (
 	EmojiWarning   = "⚠️"
 	EmojiChartDown = "📉"
 	EmojiChartUp   = "📈"
+	EmojiExtras    = "✨"
+	EmojiSold      = "🏁"
+	EmojiRepost    = "♻️"
+
+	maxHeadlineExtras = 5
+	// maxHistoryPoints is the number of the last prices shown in the price change notification
+	maxHistoryPoints = 5
 )
 
+// headlineEquipment is the equipment worth mentioning in notifications, most notable first
+var headlineEquipment = []model.Equipment{
+	model.EquipmentPanoramicRoof,
+	model.EquipmentLeatherSeats,
+	model.EquipmentAdaptiveCruise,
+	model.EquipmentHeadUpDisplay,
+	model.EquipmentCamera360,
+	model.EquipmentAppleCarPlay,
+	model.EquipmentAndroidAuto,
+	model.EquipmentNavigation,
+	model.EquipmentParkingSensors,
+	model.EquipmentRearCamera,
+	model.EquipmentHeatedSeats,
+	model.EquipmentKeyless,
+	model.EquipmentSunroof,
+}
+
 type App struct {
 	conf   *config.Config
 	parser *service.CarParsingService
 	bot    *bot.Bot
-	log    *slog.Logger
+	// notifier sends the outbox notifications, it is the bot
+	notifier notifier
+	log      *slog.Logger
+	// wake triggers the outbox dispatch without waiting for the next poll
+	wake chan struct{}
 }
 
 func New(conf *config.Config, log *slog.Logger) *App {
@@ -41,103 +74,344 @@ func New(conf *config.Config, log *slog.Logger) *App {
 		os.Exit(1)
 	}
 
-	tgBot, err := bot.New(conf.Token.TelegramBotToken, repo, log)
+	fetcher, err := parser.NewHTTPFetcher(conf.Parser)
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+	carParser := parser.New(fetcher)
+	parsingService := service.NewCarParsingService(conf.App.TargetSite, conf.Parser, carParser, repo, log)
+
+	tgBot, err := bot.New(conf.Token.TelegramBotToken, conf.Telegram, repo, parsingService, log)
 	if err != nil {
 		log.Error(err.Error())
 		os.Exit(1)
 	}
 	return &App{
-		log:    log,
-		conf:   conf,
-		bot:    tgBot,
-		parser: service.NewCarParsingService(conf.App.TargetSite, repo, log),
+		log:      log,
+		conf:     conf,
+		wake:     make(chan struct{}, 1),
+		bot:      tgBot,
+		notifier: tgBot,
+		parser:   parsingService,
 	}
 }
 
 func (a *App) Run(ctx context.Context) error {
 	a.log.Info("app running")
-	c := cron.New()
+	// a job is skipped if its previous run is still in progress
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
 
+	// the brands are needed by the filters before the first crawl
+	go func() {
+		if err := a.parser.LoadCarBrands(ctx); err != nil {
+			a.log.Error("Failed to load car brands", "err", err)
+		}
+	}()
+	go a.backfillPhotoHashes(ctx)
 	go a.bot.Run(ctx)
+	go a.dispatch(ctx)
 
 	// add cron jobs here
-	_, err := c.AddFunc("5 12 * * *", func() {
-		started := time.Now()
-		a.log.Info("Parsing started")
-		if err := a.parser.LoadCarBrands(); err != nil {
-			a.log.Error("Failed to load car brands", "err", err)
-			return
-		}
-		for brand := range a.parser.CarBrands() {
-			if err := a.parser.ParseAdsByBrand(ctx, brand); err != nil {
-				a.log.Error("Failed to parse ads by brand", "brand", brand, "err", err)
-			}
-		}
-		a.log.Info("Parsing finished!", "time", time.Since(started))
-		// update sent ads
-		err := a.parser.UpdateSent(ctx)
-		if err != nil {
-			a.log.Error("Failed to update sent ads", "err", err)
-		}
-		a.log.Info("Sending new ads to subscribers")
-		ads, err := a.parser.NewAds(ctx)
+	_, err := c.AddFunc(a.conf.Crawl.Schedule, func() {
+		a.crawl(ctx, model.CrawlModeFull)
+	})
+	if err != nil {
+		return err
+	}
+	if a.conf.Crawl.FreshSchedule != "" {
+		_, err = c.AddFunc(a.conf.Crawl.FreshSchedule, func() {
+			a.crawl(ctx, model.CrawlModeFresh)
+		})
 		if err != nil {
-			a.log.Error("Failed to get new ads", "err", err)
-			return
+			return err
 		}
-		if len(ads) == 0 {
-			a.log.Info("No new ads")
-			return
+	}
+	_, err = c.AddFunc(outboxPurgeSchedule, func() {
+		a.purgeOutbox(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.AddFunc(dailyDigestSchedule, func() {
+		a.enqueueDigests(ctx, model.DeliveryDailyDigest, time.Now().Format(time.DateOnly))
+		a.wakeDispatcher()
+	})
+	if err != nil {
+		return err
+	}
+	c.Start()
+
+	// resume today's full crawl interrupted by restart
+	unfinished, err := a.parser.HasUnfinishedRun(ctx, model.CrawlModeFull)
+	if err != nil {
+		a.log.Error("Failed to check unfinished crawl run", "err", err)
+	}
+	if unfinished {
+		go a.crawl(ctx, model.CrawlModeFull)
+	}
+	return nil
+}
+
+// backfillPhotoHashes hashes the photos of the ads stored without photo hashes
+func (a *App) backfillPhotoHashes(ctx context.Context) {
+	processed, err := a.parser.BackfillPhotoHashes(ctx)
+	if err != nil {
+		a.log.Error("Failed to backfill photo hashes", "processed", processed, "err", err)
+		return
+	}
+	if processed > 0 {
+		a.log.Info("Photo hashes backfilled", "ads", processed)
+	}
+}
+
+// crawl parses ads of all brands and enqueues notifications for subscribers.
+// Price changes and removed ads are enqueued after full crawl only.
+func (a *App) crawl(ctx context.Context, mode model.CrawlMode) {
+	started := time.Now()
+	a.log.Info("Parsing started", "mode", mode)
+	run, err := a.parser.Crawl(ctx, mode)
+	if errors.Is(err, service.ErrCrawlRunning) {
+		a.log.Info("Parsing skipped, another crawl is still in progress", "mode", mode)
+		return
+	}
+	if err != nil {
+		a.log.Error("Parsing failed", "mode", mode, "run_id", run.ID, "err", err)
+		return
+	}
+	stats := run.Stats()
+	a.log.Info("Parsing finished!", "mode", mode, "run_id", run.ID, "status", run.Status,
+		"time", time.Since(started), "brands", len(run.Brands), "failed_brands", run.FailedBrands(),
+		"pages", stats.Pages, "parsed", stats.Parsed, "new", stats.New, "updated", stats.Updated,
+		"failed", stats.Failed, "forbidden", stats.Forbidden, "requests", stats.Requests, "rate", run.Rate())
+	a.parser.LogProxyStats()
+
+	a.enqueueNewAds(ctx)
+	if mode == model.CrawlModeFull {
+		a.enqueueAdsWithNewPrice(ctx)
+		a.enqueueRemovedAds(ctx)
+	}
+	a.enqueueDigests(ctx, model.DeliveryRunDigest, fmt.Sprintf("run%d", run.ID))
+	a.wakeDispatcher()
+}
+
+// enqueueNewAds enqueues the notifications about new ads for the matching subscribers
+func (a *App) enqueueNewAds(ctx context.Context) {
+	a.log.Info("Enqueueing new ads for subscribers")
+	ads, err := a.parser.NewAds(ctx)
+	if err != nil {
+		a.log.Error("Failed to get new ads", "err", err)
+		return
+	}
+	if len(ads) == 0 {
+		a.log.Info("No new ads")
+		return
+	}
+	subscriptions, err := a.parser.ActiveSubscriptions(ctx)
+	if err != nil {
+		a.log.Error("Failed to get subscriptions", "err", err)
+		return
+	}
+	// the users already notified about the ad price don't get it as new
+	delivered, err := a.parser.DeliveredChats(ctx, adIDs(ads), model.DeliveryPriceChanged)
+	if err != nil {
+		a.log.Error("Failed to get deliveries", "err", err)
+		return
+	}
+	// the ads sent before the deliveries were tracked are not sent again
+	assumed, err := a.parser.AssumedChats(ctx, adIDs(ads))
+	if err != nil {
+		a.log.Error("Failed to get assumed deliveries", "err", err)
+		return
+	}
+	jobs := make([]model.OutboxJob, 0, len(ads))
+	for _, ad := range ads {
+		for _, chatID := range model.MatchingChats(subscriptions, ad) {
+			if slices.Contains(delivered[ad.AdID], chatID) || slices.Contains(assumed[ad.AdID], chatID) {
+				continue
+			}
+			jobs = append(jobs, model.OutboxJob{
+				Key:     model.OutboxKey(model.DeliveryNewAd, chatID, ad.AdID),
+				ChatID:  chatID,
+				AdID:    ad.AdID,
+				Event:   model.DeliveryNewAd,
+				Text:    newCarMessage(ad),
+				Photos:  ad.Photos,
+				Brand:   ad.Manufacturer,
+				Summary: newCarSummary(ad),
+			})
 		}
-		for _, ad := range ads {
-			err = a.bot.SendMessageToSubscribers(ctx, newCarMessage(ad))
+	}
+	if err = a.parser.OutboxEnqueue(ctx, jobs); err != nil {
+		a.log.Error("Failed to enqueue new ads", "err", err)
+		return
+	}
+	a.log.Info("New ads enqueued", "notifications", len(jobs))
+}
+
+// enqueueAdsWithNewPrice enqueues the notifications about price changes for the matching subscribers
+func (a *App) enqueueAdsWithNewPrice(ctx context.Context) {
+	a.log.Info("Enqueueing ads with new price for subscribers")
+	cars, err := a.parser.AdsWithNewPrice(ctx)
+	if err != nil {
+		a.log.Error("Failed to get ads with new price", "err", err)
+		return
+	}
+	if len(cars) == 0 {
+		a.log.Info("No ads with new price")
+		return
+	}
+	subscriptions, err := a.parser.ActiveSubscriptions(ctx)
+	if err != nil {
+		a.log.Error("Failed to get subscriptions", "err", err)
+		return
+	}
+	today := time.Now().Format(time.DateOnly)
+	for _, car := range cars {
+		var jobs []model.OutboxJob
+		if chats := model.MatchingChats(subscriptions, car); len(chats) > 0 {
+			history, err := a.parser.PriceHistory(ctx, car.AdID)
 			if err != nil {
-				a.log.Error("Failed to send ad", "err", err)
+				a.log.Error("Failed to get price history", "ad_id", car.AdID, "err", err)
 			}
-			err = a.parser.AdSent(ctx, ad.AdID)
-			if err != nil {
-				a.log.Error("Failed to mark ad as sent", "err", err)
+			text := priceChangedMessage(car, history)
+			for _, chatID := range chats {
+				jobs = append(jobs, model.OutboxJob{
+					Key:         model.OutboxKey(model.DeliveryPriceChanged, chatID, car.AdID, car.Price, today),
+					ChatID:      chatID,
+					AdID:        car.AdID,
+					Event:       model.DeliveryPriceChanged,
+					Text:        text,
+					Brand:       car.Manufacturer,
+					Summary:     priceChangedSummary(car),
+					PriceChange: car.Price - car.OldPrice,
+				})
 			}
 		}
-		a.log.Info("New ads sent")
-		a.log.Info("Sending ads with new price to subscribers")
-		cars, err := a.parser.AdsWithNewPrice(ctx)
+		err = a.parser.PriceNotified(ctx, car.AdID, car.Price, jobs)
 		if err != nil {
-			a.log.Error("Failed to get ads with new price", "err", err)
-			return
+			a.log.Error("Failed to enqueue price change", "ad_id", car.AdID, "err", err)
 		}
-		if len(cars) == 0 {
-			a.log.Info("No ads with new price")
-			return
+	}
+	a.log.Info("Ads with new price enqueued")
+}
+
+// enqueueRemovedAds enqueues the notifications about removed ads for the users who got the ads
+func (a *App) enqueueRemovedAds(ctx context.Context) {
+	a.log.Info("Enqueueing removed ads for subscribers")
+	ads, err := a.parser.RemovedAds(ctx)
+	if err != nil {
+		a.log.Error("Failed to get removed ads", "err", err)
+		return
+	}
+	if len(ads) == 0 {
+		a.log.Info("No removed ads")
+		return
+	}
+	ids := make([]string, 0, len(ads))
+	for _, ad := range ads {
+		ids = append(ids, ad.AdID)
+	}
+	delivered, err := a.parser.DeliveredChats(ctx, ids, model.DeliveryNewAd, model.DeliveryPriceChanged)
+	if err != nil {
+		a.log.Error("Failed to get deliveries", "err", err)
+		return
+	}
+	assumed, err := a.parser.AssumedChats(ctx, ids)
+	if err != nil {
+		a.log.Error("Failed to get assumed deliveries", "err", err)
+		return
+	}
+	subscriptions, err := a.parser.ActiveSubscriptions(ctx)
+	if err != nil {
+		a.log.Error("Failed to get subscriptions", "err", err)
+		return
+	}
+	for _, ad := range ads {
+		recipients := removedAdRecipients(ad, delivered[ad.AdID], assumed[ad.AdID], subscriptions)
+		jobs := make([]model.OutboxJob, 0, len(recipients))
+		for _, chatID := range recipients {
+			jobs = append(jobs, model.OutboxJob{
+				Key:     model.OutboxKey(model.DeliveryRemoved, chatID, ad.AdID, ad.RemovedOn.Format(time.DateOnly)),
+				ChatID:  chatID,
+				AdID:    ad.AdID,
+				Event:   model.DeliveryRemoved,
+				Text:    removedCarMessage(ad),
+				Brand:   ad.Manufacturer,
+				Summary: removedCarSummary(ad),
+			})
 		}
-		for _, car := range cars {
-			err = a.bot.SendMessageToSubscribers(ctx, priceChangedMessage(car))
-			if err != nil {
-				a.log.Error("Failed to send ad", "err", err)
-			}
-			err = a.parser.AdSent(ctx, car.AdID)
-			if err != nil {
-				a.log.Error("Failed to mark ad as sent", "err", err)
-			}
+		err = a.parser.RemovedAdNotified(ctx, ad.AdID, jobs)
+		if err != nil {
+			a.log.Error("Failed to enqueue removed ad", "ad_id", ad.AdID, "err", err)
 		}
-		a.log.Info("Ads with new price sent")
-	})
-	if err != nil {
-		return err
 	}
-	c.Start()
-	return nil
+	a.log.Info("Removed ads enqueued")
+}
+
+// removedAdRecipients returns the chats the ad was delivered to. The chats the ad is assumed to be delivered to
+// are included only if their subscriptions match the ad.
+func removedAdRecipients(ad model.RemovedAd, delivered, assumed []int64, subscriptions []model.Subscription) []int64 {
+	recipients := slices.Clone(delivered)
+	for _, chatID := range model.MatchingChats(subscriptions, ad.Car) {
+		if slices.Contains(assumed, chatID) && !slices.Contains(recipients, chatID) {
+			recipients = append(recipients, chatID)
+		}
+	}
+	return recipients
+}
+
+func adIDs(cars []model.Car) []string {
+	ids := make([]string, 0, len(cars))
+	for _, car := range cars {
+		ids = append(ids, car.AdID)
+	}
+	return ids
 }
 
 func newCarMessage(c model.Car) string {
 	return fmt.Sprintf("%s <strong>%s %s</strong> (%d)\n\n"+
-		"%s <strong>%d€</strong>\n\n"+
-		"%s %dkm (%s)\n\n<i>%s %s</i>\n%s\n%s",
-		EmojiNew, c.Manufacturer, c.Model, c.Year, EmojiEuro, c.Price, EmojiCar,
-		c.Mileage, c.Fuel, EmojiLocation, c.Address, c.Posted.Format("02.01.2006 15:04"), c.Link)
+		"%s <strong>%d€</strong>\n\n%s"+
+		"%s %dkm (%s)\n\n%s<i>%s %s</i>\n%s\n%s",
+		newCarEmoji(c), html.EscapeString(c.Manufacturer), html.EscapeString(c.Model), c.Year, EmojiEuro, c.Price,
+		repostLine(c), EmojiCar, c.Mileage, c.Fuel, extrasLine(c), EmojiLocation, html.EscapeString(c.Address),
+		c.Posted.Format("02.01.2006 15:04"), c.Link)
 }
 
-func priceChangedMessage(c model.Car) string {
+func newCarEmoji(c model.Car) string {
+	if c.IsRepost() {
+		return EmojiRepost
+	}
+	return EmojiNew
+}
+
+// repostLine returns the line about the previous listing of the reposted car or empty string
+func repostLine(c model.Car) string {
+	if !c.IsRepost() {
+		return ""
+	}
+	return fmt.Sprintf("%s Reposted, previously listed since %s at %d€\n\n",
+		EmojiRepost, c.Previous.Since.Format("02.01.2006"), c.Previous.Price)
+}
+
+// extrasLine returns the line with headline equipment of the car or empty string
+func extrasLine(c model.Car) string {
+	extras := make([]string, 0, maxHeadlineExtras)
+	for _, equipment := range headlineEquipment {
+		if len(extras) == maxHeadlineExtras {
+			break
+		}
+		if c.HasEquipment(equipment) {
+			extras = append(extras, string(equipment))
+		}
+	}
+	if len(extras) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s %s\n\n", EmojiExtras, strings.Join(extras, ", "))
+}
+
+func priceChangedMessage(c model.Car, history []model.PricePoint) string {
 
 	arrEmoji := EmojiChartDown
 	if c.Price > c.OldPrice {
@@ -145,10 +419,34 @@ func priceChangedMessage(c model.Car) string {
 	}
 	return fmt.Sprintf(
 		"%s <strong>%s %s</strong>  (%d)\n\n"+
-			"%s <s>%d€</s> %s <strong>%d€</strong>\n\n"+
+			"%s <s>%d€</s> %s <strong>%d€</strong>\n\n%s"+
 			"%s %dkm (%s)\n\n<i>%s %s</i>\n%s\n%s",
-		arrEmoji, c.Manufacturer, c.Model, c.Year, EmojiEuro, c.OldPrice, EmojiArrow, c.Price, EmojiCar,
-		c.Mileage, c.Fuel, EmojiLocation, c.Address, c.Posted.Format("02.01.2006 15:04"), c.Link)
+		arrEmoji, html.EscapeString(c.Manufacturer), html.EscapeString(c.Model), c.Year, EmojiEuro, c.OldPrice,
+		EmojiArrow, c.Price, priceHistoryLine(history), EmojiCar,
+		c.Mileage, c.Fuel, EmojiLocation, html.EscapeString(c.Address), c.Posted.Format("02.01.2006 15:04"), c.Link)
+}
+
+// priceHistoryLine returns the line with the last price changes or empty string if the price changed once
+func priceHistoryLine(history []model.PricePoint) string {
+	if len(history) <= 2 {
+		return ""
+	}
+	history = history[max(len(history)-maxHistoryPoints, 0):]
+	points := make([]string, 0, len(history))
+	for _, point := range history {
+		points = append(points, fmt.Sprintf("%d€ (%s)", point.Price, point.Date.Format("02.01")))
+	}
+	return fmt.Sprintf("%s %s\n\n", EmojiDate, strings.Join(points, " → "))
+}
+
+func removedCarMessage(ad model.RemovedAd) string {
+	return fmt.Sprintf("%s <strong>%s %s</strong> (%d) removed/sold\n\n"+
+		"%s <strong>%d€</strong>\n\n"+
+		"%s %dkm (%s)\n\n"+
+		"%s Listed %s – %s, %d days\n%s",
+		EmojiSold, html.EscapeString(ad.Manufacturer), html.EscapeString(ad.Model), ad.Year, EmojiEuro, ad.Price,
+		EmojiCar, ad.Mileage, ad.Fuel,
+		EmojiDate, ad.ListedSince.Format("02.01.2006"), ad.LastSeen.Format("02.01.2006"), ad.DaysListed, ad.Link)
 }
 
 // Close closes the app
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemovedAdRecipients(t *testing.T) {
+	ad := model.RemovedAd{Car: model.Car{AdID: "1", Manufacturer: "Toyota", Model: "Corolla", Price: 20000}}
+	subscriptions := []model.Subscription{
+		{ChatID: 1, Brands: []string{"BMW"}},
+		{ChatID: 2, Brands: []string{"Toyota"}},
+		{ChatID: 3, MaxPrice: 15000},
+		{ChatID: 4, Models: []string{"Corolla"}},
+	}
+	// chat 1 got the ad before changing the subscription, chats 2 and 3 are assumed to have got it
+	// but only the subscription of chat 2 matches the ad
+	assert.Equal(t, []int64{1, 2}, removedAdRecipients(ad, []int64{1}, []int64{2, 3}, subscriptions))
+	assert.Empty(t, removedAdRecipients(ad, nil, nil, subscriptions))
+}
+
+func TestPriceHistoryLine(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC)
+	}
+	// the price is unchanged or changed once, the notification shows the old price only
+	assert.Empty(t, priceHistoryLine(nil))
+	assert.Empty(t, priceHistoryLine([]model.PricePoint{{Date: day(1), Price: 20000}}))
+	assert.Empty(t, priceHistoryLine([]model.PricePoint{{Date: day(1), Price: 20000}, {Date: day(2), Price: 19000}}))
+
+	assert.Equal(t, EmojiDate+" 20000€ (01.05) → 19000€ (03.05) → 18500€ (07.05)\n\n",
+		priceHistoryLine([]model.PricePoint{
+			{Date: day(1), Price: 20000}, {Date: day(3), Price: 19000}, {Date: day(7), Price: 18500},
+		}))
+
+	// only the last changes are shown
+	history := make([]model.PricePoint, 0, maxHistoryPoints+2)
+	for i := 0; i < maxHistoryPoints+2; i++ {
+		history = append(history, model.PricePoint{Date: day(i + 1), Price: 20000 - i*100})
+	}
+	line := priceHistoryLine(history)
+	assert.Equal(t, maxHistoryPoints-1, strings.Count(line, "→"))
+	assert.True(t, strings.HasPrefix(line, EmojiDate+" 19800€ (03.05)"))
+}
+
+func TestPriceChangedMessageFirstChange(t *testing.T) {
+	// notified_price of the new ad is the price it is first seen with, it is never NULL,
+	// so the first notification compares the price with the first one
+	car := model.Car{Manufacturer: "Toyota", Model: "Corolla", Year: 2021, Price: 19000, OldPrice: 20000}
+	text := priceChangedMessage(car, []model.PricePoint{{Date: time.Now(), Price: 20000}, {Date: time.Now(),
+		Price: 19000}})
+	assert.Contains(t, text, EmojiChartDown+" <strong>Toyota Corolla</strong>")
+	assert.Contains(t, text, "<s>20000€</s> "+EmojiArrow+" <strong>19000€</strong>")
+	assert.NotContains(t, text, EmojiDate+" ")
+}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
+	"html"
+	"strings"
+	"time"
+)
+
+const (
+	EmojiDigest = "📰"
+
+	// dailyDigestSchedule checks every hour whose daily digest is due
+	dailyDigestSchedule = "0 * * * *"
+	// maxDigestEntries is the number of notifications on a digest page
+	maxDigestEntries = 25
+	// maxMessageLength is the telegram limit for text messages
+	maxMessageLength = 4096
+	// titleLength is the length reserved for the digest title with the page number
+	titleLength = 64
+)
+
+// digestPage is the digest message and the ids of the notifications it consists of
+type digestPage struct {
+	text string
+	ids  []int64
+}
+
+// enqueueDigests bundles the held notifications of the users with the delivery mode into digests.
+// The daily digests are made for the users whose digest hour is now only.
+// The stamp identifies the digest, the digest with the same stamp is enqueued once.
+func (a *App) enqueueDigests(ctx context.Context, mode model.DeliveryMode, stamp string) {
+	users, err := a.parser.Users(ctx)
+	if err != nil {
+		a.log.Error("Failed to get users", "err", err)
+		return
+	}
+	hour := time.Now().Hour()
+	chatIDs := make([]int64, 0)
+	for _, user := range users {
+		if !user.Approved || user.DeliveryMode != mode {
+			continue
+		}
+		if mode == model.DeliveryDailyDigest && user.DigestHour != hour {
+			continue
+		}
+		chatIDs = append(chatIDs, user.ChatID)
+	}
+	held, err := a.parser.OutboxHeld(ctx, chatIDs)
+	if err != nil {
+		a.log.Error("Failed to get held notifications", "err", err)
+		return
+	}
+	if len(held) == 0 {
+		return
+	}
+	byChat := make(map[int64][]model.OutboxJob)
+	for _, job := range held {
+		byChat[job.ChatID] = append(byChat[job.ChatID], job)
+	}
+	digests := make([]model.OutboxJob, 0, len(byChat))
+	for chatID, jobs := range byChat {
+		for i, page := range digestPages(jobs) {
+			digests = append(digests, model.OutboxJob{
+				Key:    model.OutboxKey(model.DeliveryDigest, chatID, stamp, i+1),
+				ChatID: chatID,
+				Event:  model.DeliveryDigest,
+				Text:   page.text,
+				Bundle: page.ids,
+			})
+		}
+	}
+	if err = a.parser.OutboxBundle(ctx, digests); err != nil {
+		a.log.Error("Failed to enqueue digests", "mode", mode, "err", err)
+		return
+	}
+	a.log.Info("Digests enqueued", "mode", mode, "chats", len(byChat), "notifications", len(held))
+}
+
+// digestPages splits the notifications ordered by brand into digest pages grouped by brand.
+// The first page starts with the numbers of the notifications by kind.
+func digestPages(jobs []model.OutboxJob) []digestPage {
+	header := digestHeader(jobs)
+	var pages []digestPage
+	var page digestPage
+	var body strings.Builder
+	brand := ""
+	flush := func() {
+		if len(page.ids) == 0 {
+			return
+		}
+		page.text = body.String()
+		pages = append(pages, page)
+		page = digestPage{}
+		body.Reset()
+		brand = ""
+	}
+	for _, job := range jobs {
+		entry := job.Summary + "\n"
+		if job.Brand != brand {
+			entry = "\n<strong>" + html.EscapeString(job.Brand) + "</strong>\n" + entry
+		}
+		// the title and the header are reserved on every page
+		if len(page.ids) == maxDigestEntries ||
+			titleLength+len([]rune(header))+len([]rune(body.String()))+len([]rune(entry)) > maxMessageLength {
+			flush()
+			entry = "\n<strong>" + html.EscapeString(job.Brand) + "</strong>\n" + job.Summary + "\n"
+		}
+		brand = job.Brand
+		body.WriteString(entry)
+		page.ids = append(page.ids, job.ID)
+	}
+	flush()
+	for i := range pages {
+		title := EmojiDigest + " <strong>Digest</strong>"
+		if len(pages) > 1 {
+			title += fmt.Sprintf(" %d/%d", i+1, len(pages))
+		}
+		if i == 0 {
+			title += "\n" + header
+		}
+		pages[i].text = title + "\n" + pages[i].text
+	}
+	return pages
+}
+
+// digestHeader returns the numbers of new ads, price drops and rises and removed ads
+func digestHeader(jobs []model.OutboxJob) string {
+	var newAds, drops, rises, removed int
+	for _, job := range jobs {
+		switch {
+		case job.Event == model.DeliveryNewAd:
+			newAds++
+		case job.Event == model.DeliveryPriceChanged && job.PriceChange < 0:
+			drops++
+		case job.Event == model.DeliveryPriceChanged:
+			rises++
+		case job.Event == model.DeliveryRemoved:
+			removed++
+		}
+	}
+	counts := []string{
+		fmt.Sprintf("%s %d new", EmojiNew, newAds),
+		fmt.Sprintf("%s %d price drops", EmojiChartDown, drops),
+	}
+	if rises > 0 {
+		counts = append(counts, fmt.Sprintf("%s %d price rises", EmojiChartUp, rises))
+	}
+	if removed > 0 {
+		counts = append(counts, fmt.Sprintf("%s %d removed", EmojiSold, removed))
+	}
+	return strings.Join(counts, " · ")
+}
+
+func newCarSummary(c model.Car) string {
+	return fmt.Sprintf("%s <a href=\"%s\">%s</a> (%d) <strong>%d€</strong>, %dkm",
+		newCarEmoji(c), html.EscapeString(c.Link), html.EscapeString(c.Model), c.Year, c.Price, c.Mileage)
+}
+
+func priceChangedSummary(c model.Car) string {
+	arrEmoji := EmojiChartDown
+	if c.Price > c.OldPrice {
+		arrEmoji = EmojiChartUp
+	}
+	return fmt.Sprintf("%s <a href=\"%s\">%s</a> (%d) <s>%d€</s> → <strong>%d€</strong>, %dkm",
+		arrEmoji, html.EscapeString(c.Link), html.EscapeString(c.Model), c.Year, c.OldPrice, c.Price, c.Mileage)
+}
+
+func removedCarSummary(ad model.RemovedAd) string {
+	return fmt.Sprintf("%s <a href=\"%s\">%s</a> (%d) %d€, removed after %d days",
+		EmojiSold, html.EscapeString(ad.Link), html.EscapeString(ad.Model), ad.Year, ad.Price, ad.DaysListed)
+}
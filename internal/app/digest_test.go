@@ -0,0 +1,66 @@
+package app
+
+import (
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestDigestPages(t *testing.T) {
+	jobs := []model.OutboxJob{
+		{ID: 1, Brand: "Audi", Event: model.DeliveryNewAd, Summary: "A4"},
+		{ID: 2, Brand: "Audi", Event: model.DeliveryPriceChanged, PriceChange: -500, Summary: "A6"},
+		{ID: 3, Brand: "BMW", Event: model.DeliveryPriceChanged, PriceChange: 1000, Summary: "X5"},
+	}
+	pages := digestPages(jobs)
+	assert.Len(t, pages, 1)
+	assert.Equal(t, []int64{1, 2, 3}, pages[0].ids)
+	assert.Equal(t, EmojiDigest+" <strong>Digest</strong>\n"+
+		EmojiNew+" 1 new · "+EmojiChartDown+" 1 price drops · "+EmojiChartUp+" 1 price rises\n"+
+		"\n<strong>Audi</strong>\nA4\nA6\n"+
+		"\n<strong>BMW</strong>\nX5\n", pages[0].text)
+}
+
+func TestDigestPagesPaging(t *testing.T) {
+	jobs := make([]model.OutboxJob, 0, maxDigestEntries+5)
+	for i := 0; i < maxDigestEntries+5; i++ {
+		jobs = append(jobs, model.OutboxJob{ID: int64(i + 1), Brand: "Toyota", Event: model.DeliveryNewAd,
+			Summary: fmt.Sprintf("Corolla %d", i+1)})
+	}
+	pages := digestPages(jobs)
+	assert.Len(t, pages, 2)
+	assert.Len(t, pages[0].ids, maxDigestEntries)
+	assert.Len(t, pages[1].ids, 5)
+	assert.True(t, strings.HasPrefix(pages[0].text, EmojiDigest+" <strong>Digest</strong> 1/2\n"+
+		EmojiNew+" 30 new"))
+	// the brand is repeated on the next page, the counts are not
+	assert.Equal(t, EmojiDigest+" <strong>Digest</strong> 2/2\n\n<strong>Toyota</strong>\n"+
+		"Corolla 26\nCorolla 27\nCorolla 28\nCorolla 29\nCorolla 30\n", pages[1].text)
+}
+
+func TestDigestPagesMessageLength(t *testing.T) {
+	jobs := make([]model.OutboxJob, 0, 10)
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, model.OutboxJob{ID: int64(i + 1), Brand: "BMW", Event: model.DeliveryNewAd,
+			Summary: strings.Repeat("x", 1000)})
+	}
+	pages := digestPages(jobs)
+	assert.Greater(t, len(pages), 1)
+	for _, page := range pages {
+		assert.LessOrEqual(t, len([]rune(page.text)), maxMessageLength)
+	}
+}
+
+func TestDigestEscapesNames(t *testing.T) {
+	car := model.Car{Manufacturer: "Rolls & Royce", Model: "<Ghost>", Year: 2021, Price: 90000,
+		Link: "https://example.com/ad?id=1&ref=2"}
+	summary := newCarSummary(car)
+	assert.Contains(t, summary, `<a href="https://example.com/ad?id=1&amp;ref=2">&lt;Ghost&gt;</a>`)
+
+	pages := digestPages([]model.OutboxJob{{ID: 1, Brand: car.Manufacturer, Event: model.DeliveryNewAd,
+		Summary: summary}})
+	assert.Contains(t, pages[0].text, "<strong>Rolls &amp; Royce</strong>")
+	assert.Contains(t, newCarMessage(car), "<strong>Rolls &amp; Royce &lt;Ghost&gt;</strong>")
+}
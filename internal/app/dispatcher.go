@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"github.com/bopoh24/bazacars/internal/bot"
+	"github.com/bopoh24/bazacars/internal/model"
+	"time"
+)
+
+// outboxPurgeSchedule deletes the sent notifications older than the retention time once a day
+const outboxPurgeSchedule = "30 4 * * *"
+
+// notifier sends the notifications to the chats
+type notifier interface {
+	SendAlbumOrMessage(ctx context.Context, chatID int64, photos []string, caption string) error
+	SendStats() bot.SendStats
+}
+
+// dispatch delivers the outbox notifications until the context is done
+func (a *App) dispatch(ctx context.Context) {
+	ticker := time.NewTicker(a.conf.Outbox.Interval)
+	defer ticker.Stop()
+	for {
+		dispatched := 0
+		for {
+			n := a.dispatchBatch(ctx)
+			dispatched += n
+			// the batch is full, more notifications are likely waiting
+			if n < a.conf.Outbox.BatchSize {
+				break
+			}
+		}
+		if dispatched > 0 {
+			stats := a.notifier.SendStats()
+			a.log.Info("Outbox dispatched", "notifications", dispatched, "sent", stats.Sent,
+				"failed", stats.Failed, "rate_limited", stats.RateLimited, "waited", stats.Waited)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.wake:
+		}
+	}
+}
+
+// wakeDispatcher makes the dispatcher check the outbox without waiting for the next poll
+func (a *App) wakeDispatcher() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchBatch sends the batch of due notifications and returns the number of the claimed ones
+func (a *App) dispatchBatch(ctx context.Context) int {
+	if ctx.Err() != nil {
+		return 0
+	}
+	jobs, err := a.parser.OutboxClaim(ctx, a.conf.Outbox.BatchSize, a.conf.Outbox.Lease)
+	if err != nil {
+		a.log.Error("Failed to claim outbox notifications", "err", err)
+		return 0
+	}
+	for _, job := range jobs {
+		a.dispatchJob(ctx, job)
+	}
+	return len(jobs)
+}
+
+// dispatchJob sends the notification and saves the result. Failed notifications are retried with backoff
+// until they fail for good or run out of attempts.
+// The delivery is at least once: the attempt is recorded by the claim, but the notification sent by the process
+// crashed before saving the result is sent again once the lease expires. The duplicates are limited to that case,
+// the notification is enqueued once by its key.
+func (a *App) dispatchJob(ctx context.Context, job model.OutboxJob) {
+	err := a.notifier.SendAlbumOrMessage(ctx, job.ChatID, job.Photos, job.Text)
+	job = a.jobResult(job, err)
+	// the outbox is saved even if the app is stopping, otherwise the sent notification is sent again
+	if err = a.parser.OutboxSave(context.WithoutCancel(ctx), job); err != nil {
+		a.log.Error("Failed to save outbox notification", "key", job.Key, "err", err)
+	}
+}
+
+// jobResult returns the job with the result of the sending: sent, failed for good or postponed
+func (a *App) jobResult(job model.OutboxJob, err error) model.OutboxJob {
+	switch {
+	case err == nil:
+		job.Status = model.OutboxSent
+		job.LastError = ""
+	case bot.IsPermanent(err) || job.Attempts >= a.conf.Outbox.MaxAttempts:
+		job.Status = model.OutboxFailed
+		job.LastError = err.Error()
+		a.log.Warn("Notification failed", "key", job.Key, "attempts", job.Attempts, "err", err)
+	default:
+		job.NextAttemptAt = time.Now().Add(a.retryDelay(job.Attempts))
+		job.LastError = err.Error()
+		a.log.Info("Notification postponed", "key", job.Key, "attempts", job.Attempts,
+			"next_attempt_at", job.NextAttemptAt, "err", err)
+	}
+	return job
+}
+
+// retryDelay returns the exponential backoff delay after the attempt
+func (a *App) retryDelay(attempt int) time.Duration {
+	delay := a.conf.Outbox.BackoffBase
+	for i := 1; i < attempt && delay < a.conf.Outbox.BackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, a.conf.Outbox.BackoffMax)
+}
+
+// purgeOutbox deletes the notifications sent before the retention time
+func (a *App) purgeOutbox(ctx context.Context) {
+	purged, err := a.parser.OutboxPurge(ctx, time.Now().Add(-a.conf.Outbox.Retention))
+	if err != nil {
+		a.log.Error("Failed to purge outbox", "err", err)
+		return
+	}
+	if purged > 0 {
+		a.log.Info("Sent notifications purged from outbox", "count", purged)
+	}
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/bopoh24/bazacars/internal/bot"
+	"github.com/bopoh24/bazacars/internal/config"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/parser"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"github.com/bopoh24/bazacars/internal/service"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// errNotifier fails every notification with err
+type errNotifier struct {
+	err  error
+	sent int
+}
+
+func (n *errNotifier) SendAlbumOrMessage(context.Context, int64, []string, string) error {
+	n.sent++
+	return n.err
+}
+
+func (n *errNotifier) SendStats() bot.SendStats {
+	return bot.SendStats{}
+}
+
+// outboxRepo stores the saved outbox notifications
+type outboxRepo struct {
+	repository.Repository
+	saved []model.OutboxJob
+}
+
+func (r *outboxRepo) OutboxSave(_ context.Context, job model.OutboxJob) error {
+	r.saved = append(r.saved, job)
+	return nil
+}
+
+func newTestApp(n notifier, repo repository.Repository) *App {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	conf := &config.Config{Outbox: config.Outbox{MaxAttempts: 3, BackoffBase: 30 * time.Second,
+		BackoffMax: 5 * time.Minute}}
+	return &App{
+		conf:     conf,
+		parser:   service.NewCarParsingService("", conf.Parser, parser.New(nil), repo, log),
+		notifier: n,
+		log:      log,
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	a := newTestApp(&errNotifier{}, &outboxRepo{})
+	assert.Equal(t, 30*time.Second, a.retryDelay(1))
+	assert.Equal(t, time.Minute, a.retryDelay(2))
+	assert.Equal(t, 2*time.Minute, a.retryDelay(3))
+	assert.Equal(t, 4*time.Minute, a.retryDelay(4))
+	assert.Equal(t, 5*time.Minute, a.retryDelay(5))
+	assert.Equal(t, 5*time.Minute, a.retryDelay(50))
+}
+
+func TestDispatchJobSent(t *testing.T) {
+	repo := &outboxRepo{}
+	a := newTestApp(&errNotifier{}, repo)
+	a.dispatchJob(context.Background(), model.OutboxJob{ID: 1, ChatID: 42, AdID: "1", Attempts: 2,
+		Event: model.DeliveryNewAd, LastError: "timeout"})
+
+	assert.Len(t, repo.saved, 1)
+	assert.Equal(t, model.OutboxSent, repo.saved[0].Status)
+	assert.Empty(t, repo.saved[0].LastError)
+	assert.Equal(t, model.DeliverySent, repo.saved[0].Delivery(time.Now()).Status)
+}
+
+func TestDispatchJobPermanentFailure(t *testing.T) {
+	for _, code := range []int{http.StatusBadRequest, http.StatusForbidden} {
+		repo := &outboxRepo{}
+		n := &errNotifier{err: &tgbotapi.Error{Code: code, Message: "bot was blocked by the user"}}
+		a := newTestApp(n, repo)
+		a.dispatchJob(context.Background(), model.OutboxJob{ID: 1, ChatID: 42, AdID: "1", Attempts: 1,
+			Event: model.DeliveryNewAd})
+
+		assert.Equal(t, 1, n.sent)
+		assert.Len(t, repo.saved, 1)
+		job := repo.saved[0]
+		assert.Equal(t, model.OutboxFailed, job.Status, code)
+		assert.Equal(t, n.err.Error(), job.LastError)
+		// the failed notification is recorded as the failed delivery
+		delivery := job.Delivery(time.Now())
+		assert.Equal(t, model.DeliveryFailed, delivery.Status)
+		assert.Equal(t, int64(42), delivery.ChatID)
+		assert.Equal(t, "1", delivery.AdID)
+		assert.Equal(t, n.err.Error(), delivery.Error)
+	}
+}
+
+func TestDispatchJobRetry(t *testing.T) {
+	repo := &outboxRepo{}
+	a := newTestApp(&errNotifier{err: errors.New("connection reset")}, repo)
+	started := time.Now()
+	a.dispatchJob(context.Background(), model.OutboxJob{ID: 1, ChatID: 42, AdID: "1", Attempts: 2,
+		Status: model.OutboxPending})
+
+	job := repo.saved[0]
+	assert.Equal(t, model.OutboxPending, job.Status)
+	assert.Equal(t, "connection reset", job.LastError)
+	assert.WithinDuration(t, started.Add(time.Minute), job.NextAttemptAt, time.Second)
+
+	// the last attempt fails for good
+	a.dispatchJob(context.Background(), model.OutboxJob{ID: 1, ChatID: 42, AdID: "1", Attempts: 3,
+		Status: model.OutboxPending})
+	assert.Equal(t, model.OutboxFailed, repo.saved[1].Status)
+}
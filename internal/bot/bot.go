@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/bopoh24/bazacars/internal/config"
 	"github.com/bopoh24/bazacars/internal/model"
 	"github.com/bopoh24/bazacars/internal/repository"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"log/slog"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -17,34 +20,57 @@ const (
 	emojiAdmin    = "👑"
 	emojiUser     = "👤"
 	emojiAlert    = "🚨"
+	emojiRunning  = "⏳"
 
 	commandStart   = "start"
 	commandHelp    = "help"
 	commandUsers   = "users"
 	commandApprove = "approve"
 	commandAdmins  = "admins"
+
+	commandCrawlStatus   = "crawlstatus"
+	commandSubscriptions = "subscriptions"
+	commandDelivery      = "delivery"
+	commandFilter        = "filter"
+	commandCancel        = "cancel"
+
+	// maxAlbumPhotos is the number of photos sent in a notification album
+	maxAlbumPhotos = 4
+	// maxCaptionLength is the telegram limit for media captions
+	maxCaptionLength = 1024
 )
 
 // Bot is a telegram bot
 type Bot struct {
 	api    *tgbotapi.BotAPI
+	sender *sender
 	repo   repository.Repository
+	brands BrandSource
 	logger *slog.Logger
+	// flows are the conversations by their callback action
+	flows map[callbackAction]conversationFlow
 }
 
 // New returns new bot
-func New(token string, repo repository.Repository, logger *slog.Logger) (*Bot, error) {
+func New(token string, conf config.Telegram, repo repository.Repository, brands BrandSource,
+	logger *slog.Logger) (*Bot, error) {
 	api, err := tgbotapi.NewBotAPI(token)
 	if err != nil {
 		return nil, fmt.Errorf("telegram bot: %w", err)
 	}
 	logger = logger.With(slog.String("bot", api.Self.UserName))
 
-	return &Bot{
+	b := &Bot{
 		api:    api,
+		sender: newSender(conf),
 		logger: logger,
 		repo:   repo,
-	}, nil
+		brands: brands,
+	}
+	b.flows = map[callbackAction]conversationFlow{
+		flowFilter: filterFlow{b: b},
+	}
+	return b, nil
 }
 
 // Run starts the bot
@@ -52,11 +78,15 @@ func (b *Bot) Run(ctx context.Context) {
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 	updates := b.api.GetUpdatesChan(u)
+	purge := time.NewTicker(conversationPurgeInterval)
+	defer purge.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-purge.C:
+			b.purgeConversations(ctx)
 		case update := <-updates:
 			if update.CallbackQuery != nil {
 				err := b.handleCallback(ctx, update.CallbackQuery)
@@ -98,39 +128,121 @@ func (b *Bot) Run(ctx context.Context) {
 					b.commandApproveHandler(ctx, update.Message.Chat.ID)
 				case commandAdmins:
 					b.commandAdminsHandler(ctx, update.Message.Chat.ID)
+				case commandSubscriptions:
+					b.commandSubscriptionsHandler(ctx, update.Message.Chat.ID)
+				case commandFilter:
+					b.commandFilterHandler(ctx, update.Message.Chat.ID)
+				case commandCancel:
+					b.commandCancelHandler(ctx, update.Message.Chat.ID)
+				case commandDelivery:
+					b.commandDeliveryHandler(ctx, update.Message.Chat.ID)
+				case commandCrawlStatus:
+					b.commandCrawlStatusHandler(ctx, update.Message.Chat.ID, update.Message.CommandArguments())
 				default:
 					b.SendMessage(ctx, update.Message.Chat.ID, "I don't know that command", nil)
 				}
+				continue
 			}
+			b.handleConversationText(ctx, update.Message.Chat.ID, update.Message.Text)
 		}
 	}
 }
 
-// SendMessageToSubscribers sends message to all approved users
-func (b *Bot) SendMessageToSubscribers(ctx context.Context, text string) error {
-	users, err := b.repo.Users(ctx)
-	if err != nil {
-		return fmt.Errorf("error getting users: %w", err)
+// SendAlbumOrMessage sends the first photos with caption as an album to chat.
+// If there are no photos or the album can't be sent, the caption is sent as a text message.
+func (b *Bot) SendAlbumOrMessage(ctx context.Context, chatID int64, photos []string, caption string) error {
+	if len(photos) == 0 {
+		return b.SendMessage(ctx, chatID, caption, nil)
 	}
-	for _, user := range users {
-		if user.Approved {
-			b.SendMessage(ctx, user.ChatID, text, nil)
-		}
+	if err := b.SendAlbum(ctx, chatID, photos, caption); err != nil {
+		b.logger.Warn("Error sending album, falling back to text", "err", err, "chat_id", chatID)
+		return b.SendMessage(ctx, chatID, caption, nil)
 	}
 	return nil
 }
 
+// SendAlbum sends up to maxAlbumPhotos photos with HTML caption to chat
+func (b *Bot) SendAlbum(ctx context.Context, chatID int64, photos []string, caption string) error {
+	if len(photos) == 0 {
+		return errors.New("no photos")
+	}
+	if len([]rune(caption)) > maxCaptionLength {
+		return errors.New("caption is too long")
+	}
+	if len(photos) > maxAlbumPhotos {
+		photos = photos[:maxAlbumPhotos]
+	}
+	// media group requires at least two items
+	if len(photos) == 1 {
+		photoConf := tgbotapi.NewPhoto(chatID, tgbotapi.FileURL(photos[0]))
+		photoConf.Caption = caption
+		photoConf.ParseMode = tgbotapi.ModeHTML
+		return b.sender.send(ctx, chatID, 1, func() error {
+			_, err := b.api.Send(photoConf)
+			return err
+		})
+	}
+	media := make([]interface{}, 0, len(photos))
+	for i, photo := range photos {
+		inputPhoto := tgbotapi.NewInputMediaPhoto(tgbotapi.FileURL(photo))
+		if i == 0 {
+			inputPhoto.Caption = caption
+			inputPhoto.ParseMode = tgbotapi.ModeHTML
+		}
+		media = append(media, inputPhoto)
+	}
+	return b.sender.send(ctx, chatID, len(media), func() error {
+		_, err := b.api.SendMediaGroup(tgbotapi.NewMediaGroup(chatID, media))
+		return err
+	})
+}
+
 // SendMessage sends message to chat
-func (b *Bot) SendMessage(_ context.Context, chatID int64, text string, keyboard *tgbotapi.InlineKeyboardMarkup) {
+func (b *Bot) SendMessage(ctx context.Context, chatID int64, text string,
+	keyboard *tgbotapi.InlineKeyboardMarkup) error {
 	msgConf := tgbotapi.NewMessage(chatID, text)
 	msgConf.ParseMode = tgbotapi.ModeHTML
 	if keyboard != nil {
 		msgConf.ReplyMarkup = keyboard
 	}
-	_, err := b.api.Send(msgConf)
+	err := b.sender.send(ctx, chatID, 1, func() error {
+		_, err := b.api.Send(msgConf)
+		return err
+	})
 	if err != nil {
-		b.logger.Error("Error sending message", "err", err)
+		b.logger.Error("Error sending message", "err", err, "chat_id", chatID)
+	}
+	return err
+}
+
+// editMessage replaces the text and the keyboard of the message
+func (b *Bot) editMessage(ctx context.Context, chatID int64, messageID int, text string,
+	keyboard *tgbotapi.InlineKeyboardMarkup) error {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	edit.ParseMode = tgbotapi.ModeHTML
+	edit.ReplyMarkup = keyboard
+	err := b.sender.send(ctx, chatID, 1, func() error {
+		_, err := b.api.Send(edit)
+		return err
+	})
+	// the same page or option may be chosen again
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
 	}
+	return err
+}
+
+// SendStats returns the statistics of the requests sent to telegram
+func (b *Bot) SendStats() SendStats {
+	return b.sender.stats()
+}
+
+// IsPermanent reports whether the message can't be sent on retry, e.g. the chat is not found
+// or the bot is blocked by the user
+func IsPermanent(err error) bool {
+	var tgErr *tgbotapi.Error
+	return errors.As(err, &tgErr) &&
+		(tgErr.Code == http.StatusBadRequest || tgErr.Code == http.StatusForbidden)
 }
 
 func (b *Bot) userInfoFromChat(chat *tgbotapi.Chat) string {
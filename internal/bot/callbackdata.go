@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxCallbackData is the telegram limit for the callback data of the button in bytes
+	maxCallbackData = 64
+	// callbackSeparator separates the action and the arguments in the callback data
+	callbackSeparator = ":"
+)
+
+var (
+	errCallbackTooLong = errors.New("callback data is too long")
+	errCallbackInvalid = errors.New("callback data is invalid")
+)
+
+// callbackData is the action of the button with its arguments, encoded compactly as action:arg:arg
+type callbackData struct {
+	action callbackAction
+	args   []string
+}
+
+// newCallbackData returns the callback data of the action, the arguments are formatted with fmt.Sprint
+func newCallbackData(action callbackAction, args ...any) callbackData {
+	data := callbackData{action: action, args: make([]string, 0, len(args))}
+	for _, arg := range args {
+		data.args = append(data.args, fmt.Sprint(arg))
+	}
+	return data
+}
+
+// encode returns the callback data of the button. The arguments must not contain the separator.
+func (d callbackData) encode() (string, error) {
+	if d.action == "" || strings.Contains(string(d.action), callbackSeparator) {
+		return "", errCallbackInvalid
+	}
+	for _, arg := range d.args {
+		if strings.Contains(arg, callbackSeparator) {
+			return "", fmt.Errorf("%w: argument %q contains separator", errCallbackInvalid, arg)
+		}
+	}
+	encoded := strings.Join(append([]string{string(d.action)}, d.args...), callbackSeparator)
+	if len(encoded) > maxCallbackData {
+		return "", fmt.Errorf("%w: %d bytes", errCallbackTooLong, len(encoded))
+	}
+	return encoded, nil
+}
+
+// decodeCallbackData parses the callback data of the button
+func decodeCallbackData(data string) (callbackData, error) {
+	if data == "" || len(data) > maxCallbackData {
+		return callbackData{}, errCallbackInvalid
+	}
+	parts := strings.Split(data, callbackSeparator)
+	return callbackData{action: callbackAction(parts[0]), args: parts[1:]}, nil
+}
+
+// arg returns the argument by index
+func (d callbackData) arg(i int) (string, error) {
+	if i < 0 || i >= len(d.args) {
+		return "", fmt.Errorf("%w: no argument %d", errCallbackInvalid, i)
+	}
+	return d.args[i], nil
+}
+
+// intArg returns the integer argument by index
+func (d callbackData) intArg(i int) (int64, error) {
+	arg, err := d.arg(i)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: argument %d is not a number", errCallbackInvalid, i)
+	}
+	return value, nil
+}
+
+// callbackButton returns the inline keyboard button with the callback data
+func callbackButton(text string, data callbackData) (tgbotapi.InlineKeyboardButton, error) {
+	encoded, err := data.encode()
+	if err != nil {
+		return tgbotapi.InlineKeyboardButton{}, err
+	}
+	return tgbotapi.NewInlineKeyboardButtonData(text, encoded), nil
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCallbackDataRoundTrip(t *testing.T) {
+	encoded, err := newCallbackData(actionApprove, int64(-1001234567890)).encode()
+	assert.NoError(t, err)
+	assert.Equal(t, "ap:-1001234567890", encoded)
+
+	data, err := decodeCallbackData(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, actionApprove, data.action)
+	chatID, err := data.intArg(0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1001234567890), chatID)
+
+	_, err = data.intArg(1)
+	assert.ErrorIs(t, err, errCallbackInvalid)
+}
+
+func TestCallbackDataLimits(t *testing.T) {
+	_, err := newCallbackData(actionDelivery, strings.Repeat("x", maxCallbackData)).encode()
+	assert.ErrorIs(t, err, errCallbackTooLong)
+
+	_, err = newCallbackData(actionDelivery, "a:b").encode()
+	assert.ErrorIs(t, err, errCallbackInvalid)
+
+	_, err = decodeCallbackData(strings.Repeat("x", maxCallbackData+1))
+	assert.ErrorIs(t, err, errCallbackInvalid)
+
+	data, err := decodeCallbackData(`{"approve":123}`)
+	assert.NoError(t, err)
+	_, err = data.intArg(0)
+	assert.Error(t, err)
+}
+
+func TestConversationButtonFits(t *testing.T) {
+	button := conversationButton(flowFilter, int(filterStepReview), "Cancel", string(filterOpCancel),
+		math.MinInt64)
+	assert.NotNil(t, button.CallbackData)
+	assert.LessOrEqual(t, len(*button.CallbackData), maxCallbackData)
+
+	data, err := decodeCallbackData(*button.CallbackData)
+	assert.NoError(t, err)
+	assert.Equal(t, flowFilter, data.action)
+	value, err := data.intArg(2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MinInt64), value)
+}
@@ -2,49 +2,67 @@ package bot
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type callbackAction string
 
+// the actions are short to fit the callback data limit
 const (
-	actionApprove callbackAction = "approve"
-	actionAdmin   callbackAction = "admin"
+	actionApprove callbackAction = "ap"
+	actionAdmin   callbackAction = "ad"
+
+	actionDelivery   callbackAction = "dm"
+	actionDigestHour callbackAction = "dh"
 )
 
 func (b *Bot) handleCallback(ctx context.Context, query *tgbotapi.CallbackQuery) error {
-	callback := tgbotapi.NewDeleteMessage(query.Message.Chat.ID, query.Message.MessageID)
-	_, err := b.api.Request(callback)
+	data, err := decodeCallbackData(query.Data)
 	if err != nil {
-		return fmt.Errorf("error sending callback request: %w", err)
+		b.answerCallback(ctx, query.ID, menuOutdated)
+		return nil
+	}
+	// the conversations edit their messages
+	if _, ok := b.flows[data.action]; ok {
+		if err = b.handleConversationCallback(ctx, query, data); err != nil {
+			return fmt.Errorf("error handle conversation callback: %w", err)
+		}
+		return nil
 	}
 
-	var action map[callbackAction]any
-	if err := json.Unmarshal([]byte(query.Data), &action); err != nil {
-		return fmt.Errorf("error unmarshal action: %w", err)
+	callback := tgbotapi.NewDeleteMessage(query.Message.Chat.ID, query.Message.MessageID)
+	err = b.sender.send(ctx, 0, 1, func() error {
+		_, err := b.api.Request(callback)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error sending callback request: %w", err)
 	}
 
-	if action[actionApprove] != nil {
-		err := b.handleApproveCallback(ctx, action[actionApprove], query.Message.Chat.ID)
-		if err != nil {
-			return fmt.Errorf("error handle approve callback action: %w", err)
-		}
+	switch data.action {
+	case actionApprove:
+		err = b.handleApproveCallback(ctx, data, query.Message.Chat.ID)
+	case actionAdmin:
+		err = b.handleAdminCallback(ctx, data, query.Message.Chat.ID)
+	case actionDelivery:
+		err = b.handleDeliveryCallback(ctx, data, query.Message.Chat.ID)
+	case actionDigestHour:
+		err = b.handleDigestHourCallback(ctx, data, query.Message.Chat.ID)
+	default:
+		// the buttons of the former versions
+		b.answerCallback(ctx, query.ID, menuOutdated)
+		return nil
 	}
-	if action[actionAdmin] != nil {
-		err := b.handleAdminCallback(ctx, action[actionAdmin], query.Message.Chat.ID)
-		if err != nil {
-			return fmt.Errorf("error handle admin callback action: %w", err)
-		}
+	if err != nil {
+		return fmt.Errorf("error handle %s callback action: %w", data.action, err)
 	}
-
 	return nil
 }
 
-func (b *Bot) handleApproveCallback(ctx context.Context, actionData any, chatID int64) error {
-	userChatID, err := getChatIDFromData(actionData)
+func (b *Bot) handleApproveCallback(ctx context.Context, data callbackData, chatID int64) error {
+	userChatID, err := data.intArg(0)
 	if err != nil {
 		return err
 	}
@@ -59,7 +77,15 @@ func (b *Bot) handleApproveCallback(ctx context.Context, actionData any, chatID
 	var answer string
 	if user.Approved {
 		answer = fmt.Sprintf("%s User %s approved!", emojiApproved, user)
-		b.SendMessage(ctx, user.ChatID, emojiApproved+" You are approved!", nil)
+		text := emojiApproved + " You are approved!"
+		subscribed, err := b.subscribeByDefault(ctx, user.ChatID)
+		if err != nil {
+			return fmt.Errorf("error creating default subscription: %w", err)
+		}
+		if subscribed {
+			text += "\nYou are subscribed to the default filter, see /subscriptions"
+		}
+		b.SendMessage(ctx, user.ChatID, text, nil)
 	} else {
 		answer = fmt.Sprintf("%s User %s denied!", emojiDeclined, user)
 	}
@@ -69,8 +95,21 @@ func (b *Bot) handleApproveCallback(ctx context.Context, actionData any, chatID
 	return nil
 }
 
-func (b *Bot) handleAdminCallback(ctx context.Context, actionData any, chatID int64) error {
-	userChatID, err := getChatIDFromData(actionData)
+// subscribeByDefault creates the default subscription for the user who has no subscriptions
+// and reports whether it was created
+func (b *Bot) subscribeByDefault(ctx context.Context, chatID int64) (bool, error) {
+	subscriptions, err := b.repo.Subscriptions(ctx, chatID)
+	if err != nil || len(subscriptions) > 0 {
+		return false, err
+	}
+	if _, err = b.repo.SubscriptionSave(ctx, model.DefaultSubscription(chatID)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *Bot) handleAdminCallback(ctx context.Context, data callbackData, chatID int64) error {
+	userChatID, err := data.intArg(0)
 	if err != nil {
 		return err
 	}
@@ -105,10 +144,13 @@ func (b *Bot) handleAdminCallback(ctx context.Context, actionData any, chatID in
 	return nil
 }
 
-func getChatIDFromData(actionData any) (int64, error) {
-	userChatIDFloat64, ok := actionData.(float64) // json marshaled as float64!
-	if !ok {
-		return 0, errors.New("error to parse chat id")
+// answerCallback stops the progress of the callback button showing the text if any
+func (b *Bot) answerCallback(ctx context.Context, queryID, text string) {
+	err := b.sender.send(ctx, 0, 1, func() error {
+		_, err := b.api.Request(tgbotapi.NewCallback(queryID, text))
+		return err
+	})
+	if err != nil {
+		b.logger.Warn("Error answering callback", "err", err)
 	}
-	return int64(userChatIDFloat64), nil
 }
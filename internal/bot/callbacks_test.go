@@ -0,0 +1,53 @@
+package bot
+
+import (
+	"context"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// subscriptionRepo stores the subscriptions in memory
+type subscriptionRepo struct {
+	repository.Repository
+	subscriptions []model.Subscription
+}
+
+func (r *subscriptionRepo) Subscriptions(_ context.Context, chatID int64) ([]model.Subscription, error) {
+	var result []model.Subscription
+	for _, s := range r.subscriptions {
+		if s.ChatID == chatID {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+func (r *subscriptionRepo) SubscriptionSave(_ context.Context, s model.Subscription) (int64, error) {
+	s.ID = int64(len(r.subscriptions) + 1)
+	r.subscriptions = append(r.subscriptions, s)
+	return s.ID, nil
+}
+
+func TestSubscribeByDefault(t *testing.T) {
+	repo := &subscriptionRepo{subscriptions: []model.Subscription{{ID: 1, ChatID: 2, Name: "Mine"}}}
+	b := &Bot{repo: repo}
+
+	// approved user without subscriptions gets the default one
+	subscribed, err := b.subscribeByDefault(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, subscribed)
+	subscriptions, _ := repo.Subscriptions(context.Background(), 1)
+	assert.Len(t, subscriptions, 1)
+	assert.Equal(t, "Default", subscriptions[0].Name)
+	assert.True(t, subscriptions[0].Match(model.Car{Manufacturer: "BMW", Model: "X3", Year: 2021,
+		Mileage: 30000, EngineSize: 2, AutomaticGearbox: true, Price: 28000}))
+
+	// the subscriptions of the user approved again are kept
+	subscribed, err = b.subscribeByDefault(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.False(t, subscribed)
+	subscriptions, _ = repo.Subscriptions(context.Background(), 2)
+	assert.Equal(t, []model.Subscription{{ID: 1, ChatID: 2, Name: "Mine"}}, subscriptions)
+}
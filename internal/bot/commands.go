@@ -2,9 +2,21 @@ package bot
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCrawlRuns is the number of crawl runs shown by /crawlstatus without arguments
+	defaultCrawlRuns = 5
+	maxCrawlRuns     = 20
+	// maxCrawlStatusBrands is the number of failed or blocked brands shown per run
+	maxCrawlStatusBrands = 10
 )
 
 const greetingMessage = `
@@ -61,18 +73,13 @@ func (b *Bot) commandApproveHandler(ctx context.Context, chatID int64) {
 		}
 		btnText := fmt.Sprintf("%s %s", emoji, user)
 
-		action := map[callbackAction]int64{
-			actionApprove: user.ChatID,
-		}
-		res, err := json.Marshal(action)
+		button, err := callbackButton(btnText, newCallbackData(actionApprove, user.ChatID))
 		if err != nil {
-			b.logger.Error("Error marshal action", "err", err)
+			b.logger.Error("Error encoding callback data", "err", err)
 			continue
 		}
 
-		buttonRows = append(buttonRows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(btnText, string(res)),
-		))
+		buttonRows = append(buttonRows, tgbotapi.NewInlineKeyboardRow(button))
 	}
 	if len(buttonRows) == 0 {
 		b.SendMessage(ctx, chatID, "No users to approve/deny", nil)
@@ -106,23 +113,90 @@ func (b *Bot) commandAdminsHandler(ctx context.Context, chatID int64) {
 		}
 		btnText := fmt.Sprintf("%s %s", emoji, user)
 
-		action := map[callbackAction]int64{
-			actionAdmin: user.ChatID,
-		}
-		res, err := json.Marshal(action)
+		button, err := callbackButton(btnText, newCallbackData(actionAdmin, user.ChatID))
 		if err != nil {
-			b.logger.Error("Error marshal action", "err", err)
+			b.logger.Error("Error encoding callback data", "err", err)
 			continue
 		}
 
-		buttonRows = append(buttonRows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(btnText, string(res)),
-		))
+		buttonRows = append(buttonRows, tgbotapi.NewInlineKeyboardRow(button))
 	}
 	keyboard := tgbotapi.NewInlineKeyboardMarkup(buttonRows...)
 	b.SendMessage(ctx, chatID, "Select user to make admin or remove admin", &keyboard)
 }
 
+func (b *Bot) commandCrawlStatusHandler(ctx context.Context, chatID int64, args string) {
+	// admin only
+	if !b.isUserAdmin(ctx, chatID) {
+		b.SendMessage(ctx, chatID, "You are not admin", nil)
+		return
+	}
+	limit := defaultCrawlRuns
+	if args = strings.TrimSpace(args); args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 {
+			b.SendMessage(ctx, chatID, "Usage: /crawlstatus [number of runs]", nil)
+			return
+		}
+		limit = min(n, maxCrawlRuns)
+	}
+	runs, err := b.repo.CrawlRuns(ctx, limit)
+	if err != nil {
+		b.logger.Error("Error getting crawl runs", "err", err)
+		return
+	}
+	if len(runs) == 0 {
+		b.SendMessage(ctx, chatID, "No crawl runs yet", nil)
+		return
+	}
+	// each run is a separate message to stay within the message length limit
+	for _, run := range runs {
+		b.SendMessage(ctx, chatID, crawlRunMessage(run), nil)
+	}
+}
+
+func crawlRunMessage(run model.CrawlRun) string {
+	emoji := emojiApproved
+	switch run.Status {
+	case model.CrawlStatusRunning, model.CrawlStatusPending:
+		emoji = emojiRunning
+	case model.CrawlStatusFailed:
+		emoji = emojiDeclined
+	}
+	stats := run.Stats()
+	msg := fmt.Sprintf("%s <strong>#%d %s</strong> %s\n", emoji, run.ID, run.Mode, run.Status)
+	msg += fmt.Sprintf("Started: %s, took %s\n", run.StartedAt.Format(time.DateTime),
+		run.Duration().Round(time.Second))
+	msg += fmt.Sprintf("Brands: %d (failed %d), pages: %d\n", len(run.Brands), run.FailedBrands(), stats.Pages)
+	msg += fmt.Sprintf("Ads: parsed %d, new %d, updated %d, unchanged %d, failed %d\n",
+		stats.Parsed, stats.New, stats.Updated, stats.Unchanged, stats.Failed)
+	msg += fmt.Sprintf("Requests: %d, %.2f req/s, 403 responses: %d\n", stats.Requests, run.Rate(),
+		stats.Forbidden)
+	if run.Error != "" {
+		msg += fmt.Sprintf("Error: %s\n", html.EscapeString(run.Error))
+	}
+
+	// brands which failed or were blocked
+	shown := 0
+	for _, brand := range run.Brands {
+		if brand.Status != model.CrawlStatusFailed && brand.Forbidden == 0 {
+			continue
+		}
+		if shown == maxCrawlStatusBrands {
+			msg += "...\n"
+			break
+		}
+		shown++
+		msg += fmt.Sprintf("%s %s: %s, pages %d/%d, 403: %d, %.2f req/s, %s\n", emojiAlert,
+			html.EscapeString(brand.Brand), brand.Status, brand.LastPage, brand.TotalPages, brand.Forbidden,
+			brand.Rate(), brand.Duration.Round(time.Second))
+		if brand.Error != "" {
+			msg += fmt.Sprintf("    %s\n", html.EscapeString(brand.Error))
+		}
+	}
+	return msg
+}
+
 func (b *Bot) isUserAdmin(ctx context.Context, chatID int64) bool {
 	user, err := b.repo.User(ctx, chatID)
 	if err != nil {
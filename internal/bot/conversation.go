@@ -0,0 +1,200 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/repository"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"time"
+)
+
+const (
+	// conversationTimeout is the idle time after which the conversation is over
+	conversationTimeout = 30 * time.Minute
+	// conversationPurgeInterval is the interval the expired conversations are deleted with
+	conversationPurgeInterval = time.Hour
+
+	menuOutdated = "The menu is outdated"
+)
+
+// conversationFlow is a multi-step interaction with the user. The flow keeps its state in the conversation
+// between the updates, the conversation is persisted after every update and expires after conversationTimeout.
+type conversationFlow interface {
+	// start shows the first step of the conversation
+	start(ctx context.Context, conv *conversation) error
+	// handleCallback handles the button of the current step pressed in the message
+	handleCallback(ctx context.Context, conv *conversation, messageID int, op string, value int64) error
+	// handleText handles the message sent at the current step
+	handleText(ctx context.Context, conv *conversation, text string) error
+}
+
+// conversation is the conversation handled by the flow
+type conversation struct {
+	model.Conversation
+	// done ends the conversation once the update is handled
+	done bool
+}
+
+// state decodes the flow state of the conversation into v
+func (c *conversation) state(v any) error {
+	if len(c.Data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(c.Data, v); err != nil {
+		return fmt.Errorf("error decoding %s conversation state: %w", c.Flow, err)
+	}
+	return nil
+}
+
+// setState encodes v as the flow state of the conversation
+func (c *conversation) setState(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %s conversation state: %w", c.Flow, err)
+	}
+	c.Data = data
+	return nil
+}
+
+// conversationButton returns the button of the flow step. The flow receives the op and the value on press.
+func conversationButton(flow callbackAction, step int, text, op string, value int64) tgbotapi.InlineKeyboardButton {
+	// the flow, the step, a short op and an int64 value always fit the callback data limit
+	data, _ := newCallbackData(flow, step, op, value).encode()
+	return tgbotapi.NewInlineKeyboardButtonData(text, data)
+}
+
+// startConversation starts the flow replacing the current conversation of the user if any
+func (b *Bot) startConversation(ctx context.Context, chatID int64, flow callbackAction) error {
+	conv := &conversation{Conversation: model.Conversation{ChatID: chatID, Flow: string(flow)}}
+	if err := b.flows[flow].start(ctx, conv); err != nil {
+		return err
+	}
+	return b.saveConversation(ctx, conv)
+}
+
+// handleConversationCallback passes the button press to the flow of the conversation.
+// The buttons of the other steps and of the finished conversations are outdated.
+func (b *Bot) handleConversationCallback(ctx context.Context, query *tgbotapi.CallbackQuery,
+	data callbackData) error {
+	chatID := query.Message.Chat.ID
+	conv, err := b.conversation(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	step, stepErr := data.intArg(0)
+	op, opErr := data.arg(1)
+	value, valueErr := data.intArg(2)
+	if conv == nil || conv.Flow != string(data.action) || errors.Join(stepErr, opErr, valueErr) != nil ||
+		int(step) != conv.Step {
+		b.answerCallback(ctx, query.ID, menuOutdated)
+		return nil
+	}
+	if conv.ExpiresAt.Before(time.Now()) {
+		b.answerCallback(ctx, query.ID, "The conversation is timed out")
+		return b.endConversation(ctx, chatID, query.Message.MessageID)
+	}
+	b.answerCallback(ctx, query.ID, "")
+	if err = b.flows[data.action].handleCallback(ctx, conv, query.Message.MessageID, op, value); err != nil {
+		return err
+	}
+	return b.saveConversation(ctx, conv)
+}
+
+// handleConversationText passes the message to the flow of the conversation.
+// It reports whether the user has a conversation.
+func (b *Bot) handleConversationText(ctx context.Context, chatID int64, text string) bool {
+	conv, err := b.conversation(ctx, chatID)
+	if err != nil {
+		b.logger.Error("Error getting conversation", "err", err, "chat_id", chatID)
+		return false
+	}
+	if conv == nil {
+		return false
+	}
+	if conv.ExpiresAt.Before(time.Now()) {
+		if err = b.repo.ConversationDelete(ctx, chatID); err != nil {
+			b.logger.Error("Error deleting conversation", "err", err, "chat_id", chatID)
+		}
+		b.SendMessage(ctx, chatID, "The conversation is timed out, start it again", nil)
+		return true
+	}
+	err = b.flows[callbackAction(conv.Flow)].handleText(ctx, conv, text)
+	if err == nil {
+		err = b.saveConversation(ctx, conv)
+	}
+	if err != nil {
+		b.logger.Error("Error handling conversation message", "err", err, "chat_id", chatID, "flow", conv.Flow)
+		b.SendMessage(ctx, chatID, "Error handling message. Try again...", nil)
+	}
+	return true
+}
+
+func (b *Bot) commandCancelHandler(ctx context.Context, chatID int64) {
+	conv, err := b.conversation(ctx, chatID)
+	if err != nil {
+		b.logger.Error("Error getting conversation", "err", err, "chat_id", chatID)
+		return
+	}
+	if conv == nil {
+		b.SendMessage(ctx, chatID, "Nothing to cancel", nil)
+		return
+	}
+	if err = b.repo.ConversationDelete(ctx, chatID); err != nil {
+		b.logger.Error("Error deleting conversation", "err", err, "chat_id", chatID)
+		return
+	}
+	b.SendMessage(ctx, chatID, "Cancelled", nil)
+}
+
+// endConversation deletes the conversation and removes the keyboard of its message
+func (b *Bot) endConversation(ctx context.Context, chatID int64, messageID int) error {
+	if err := b.repo.ConversationDelete(ctx, chatID); err != nil {
+		return fmt.Errorf("error deleting conversation: %w", err)
+	}
+	return b.editMessage(ctx, chatID, messageID, "The conversation is over", nil)
+}
+
+// conversation returns the conversation of the user or nil if there is none
+func (b *Bot) conversation(ctx context.Context, chatID int64) (*conversation, error) {
+	c, err := b.repo.Conversation(ctx, chatID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting conversation: %w", err)
+	}
+	if _, ok := b.flows[callbackAction(c.Flow)]; !ok {
+		return nil, nil
+	}
+	return &conversation{Conversation: c}, nil
+}
+
+// saveConversation saves the conversation extending its timeout or deletes it if it is done
+func (b *Bot) saveConversation(ctx context.Context, conv *conversation) error {
+	if conv.done {
+		if err := b.repo.ConversationDelete(ctx, conv.ChatID); err != nil {
+			return fmt.Errorf("error deleting conversation: %w", err)
+		}
+		return nil
+	}
+	conv.ExpiresAt = time.Now().Add(conversationTimeout)
+	if err := b.repo.ConversationSave(ctx, conv.Conversation); err != nil {
+		return fmt.Errorf("error saving conversation: %w", err)
+	}
+	return nil
+}
+
+// purgeConversations deletes the expired conversations
+func (b *Bot) purgeConversations(ctx context.Context) {
+	purged, err := b.repo.ConversationsExpire(ctx, time.Now())
+	if err != nil {
+		b.logger.Error("Error deleting expired conversations", "err", err)
+		return
+	}
+	if purged > 0 {
+		b.logger.Info("Expired conversations deleted", "count", purged)
+	}
+}
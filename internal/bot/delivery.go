@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// hoursPerRow is the number of buttons in a row of the digest hour keyboard
+const hoursPerRow = 6
+
+var deliveryModeNames = map[model.DeliveryMode]string{
+	model.DeliveryInstant:     "Instant, every ad in a separate message",
+	model.DeliveryRunDigest:   "Digest after every crawl",
+	model.DeliveryDailyDigest: "Daily digest",
+}
+
+func (b *Bot) commandDeliveryHandler(ctx context.Context, chatID int64) {
+	user, err := b.repo.User(ctx, chatID)
+	if err != nil {
+		b.logger.Error("Error getting user", "err", err, "chat_id", chatID)
+		return
+	}
+	buttonRows := make([][]tgbotapi.InlineKeyboardButton, 0, len(deliveryModeNames))
+	for _, mode := range []model.DeliveryMode{model.DeliveryInstant, model.DeliveryRunDigest,
+		model.DeliveryDailyDigest} {
+		button, err := callbackButton(deliveryModeNames[mode], newCallbackData(actionDelivery, mode))
+		if err != nil {
+			b.logger.Error("Error encoding callback data", "err", err)
+			return
+		}
+		buttonRows = append(buttonRows, tgbotapi.NewInlineKeyboardRow(button))
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(buttonRows...)
+	b.SendMessage(ctx, chatID, fmt.Sprintf("Notifications: <strong>%s</strong>\n\nSelect how to get notifications",
+		deliveryModeText(user)), &keyboard)
+}
+
+func (b *Bot) handleDeliveryCallback(ctx context.Context, data callbackData, chatID int64) error {
+	mode, err := data.arg(0)
+	if err != nil || deliveryModeNames[model.DeliveryMode(mode)] == "" {
+		return errors.New("error to parse delivery mode")
+	}
+	if model.DeliveryMode(mode) == model.DeliveryDailyDigest {
+		return b.sendDigestHourKeyboard(ctx, chatID)
+	}
+	user, err := b.repo.User(ctx, chatID)
+	if err != nil {
+		return fmt.Errorf("error getting user: %w", err)
+	}
+	return b.saveDelivery(ctx, user, model.DeliveryMode(mode), user.DigestHour)
+}
+
+func (b *Bot) handleDigestHourCallback(ctx context.Context, data callbackData, chatID int64) error {
+	hour, err := data.intArg(0)
+	if err != nil || hour < 0 || hour > 23 {
+		return errors.New("error to parse digest hour")
+	}
+	user, err := b.repo.User(ctx, chatID)
+	if err != nil {
+		return fmt.Errorf("error getting user: %w", err)
+	}
+	return b.saveDelivery(ctx, user, model.DeliveryDailyDigest, int(hour))
+}
+
+func (b *Bot) saveDelivery(ctx context.Context, user model.User, mode model.DeliveryMode, hour int) error {
+	if err := b.repo.UserDeliverySave(ctx, user.ChatID, mode, hour); err != nil {
+		return fmt.Errorf("error updating delivery mode: %w", err)
+	}
+	user.DeliveryMode = mode
+	user.DigestHour = hour
+	b.SendMessage(ctx, user.ChatID, fmt.Sprintf("%s Notifications: <strong>%s</strong>",
+		emojiApproved, deliveryModeText(user)), nil)
+	return nil
+}
+
+func (b *Bot) sendDigestHourKeyboard(ctx context.Context, chatID int64) error {
+	buttonRows := make([][]tgbotapi.InlineKeyboardButton, 0, 24/hoursPerRow)
+	for hour := 0; hour < 24; hour++ {
+		if hour%hoursPerRow == 0 {
+			buttonRows = append(buttonRows, tgbotapi.NewInlineKeyboardRow())
+		}
+		button, err := callbackButton(fmt.Sprintf("%02d:00", hour), newCallbackData(actionDigestHour, hour))
+		if err != nil {
+			return fmt.Errorf("error encoding callback data: %w", err)
+		}
+		row := len(buttonRows) - 1
+		buttonRows[row] = append(buttonRows[row], button)
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(buttonRows...)
+	b.SendMessage(ctx, chatID, "Select the time of the daily digest", &keyboard)
+	return nil
+}
+
+// deliveryModeText returns the description of the delivery mode of the user
+func deliveryModeText(user model.User) string {
+	if user.DeliveryMode == model.DeliveryDailyDigest {
+		return fmt.Sprintf("%s at %02d:00", deliveryModeNames[user.DeliveryMode], user.DigestHour)
+	}
+	if name, ok := deliveryModeNames[user.DeliveryMode]; ok {
+		return name
+	}
+	return deliveryModeNames[model.DeliveryInstant]
+}
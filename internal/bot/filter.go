@@ -0,0 +1,541 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	emojiSelected = "✅"
+	emojiEdit     = "✏️"
+	emojiDelete   = "🗑"
+
+	// filterPageSize is the number of options on a page of the filter wizard keyboard
+	filterPageSize = 24
+	// filterRowSize is the number of options in a row of the filter wizard keyboard
+	filterRowSize = 3
+	// maxFilterNameBrands is the number of brands in the generated filter name
+	maxFilterNameBrands = 3
+)
+
+// districts are the districts the filter can be limited to
+var districts = []string{"Nicosia", "Limassol", "Larnaca", "Paphos", "Famagusta"}
+
+var fuelTypes = []model.FuelType{model.FuelTypePetrol, model.FuelTypeDiesel, model.FuelTypeHybridPetrol,
+	model.FuelTypeHybridDiesel, model.FuelTypePluginHybridPetrol, model.FuelTypePluginHybridDiesel,
+	model.FuelTypeElectric, model.FuelTypeLPG}
+
+var gearboxes = []model.Gearbox{model.GearboxAny, model.GearboxAutomatic, model.GearboxManual}
+
+// BrandSource provides the car brands the filters are made of
+type BrandSource interface {
+	CarBrands() map[string]string
+}
+
+// filterStep is the step of the filter wizard
+type filterStep int
+
+const (
+	filterStepList filterStep = iota
+	filterStepBrands
+	filterStepModels
+	filterStepPrice
+	filterStepYear
+	filterStepMileage
+	filterStepFuel
+	filterStepGearbox
+	filterStepDistricts
+	filterStepReview
+	// filterStepDelete confirms the deletion of the filter, it is not a step of the editing
+	filterStepDelete
+)
+
+// flowFilter is the conversation of the filter editing
+const flowFilter callbackAction = "f"
+
+// filterOp is the action of the filter wizard button
+type filterOp string
+
+const (
+	filterOpNew    filterOp = "new"
+	filterOpEdit   filterOp = "edit"
+	filterOpDelete filterOp = "del"
+	filterOpRemove filterOp = "rm"
+	filterOpToggle filterOp = "tog"
+	filterOpPage   filterOp = "page"
+	filterOpAny    filterOp = "any"
+	filterOpNext   filterOp = "next"
+	filterOpBack   filterOp = "back"
+	filterOpSave   filterOp = "save"
+	filterOpCancel filterOp = "cancel"
+)
+
+// filterWizard is the state of the filter editing kept in the conversation, the step is the conversation step
+type filterWizard struct {
+	step         filterStep
+	Subscription model.Subscription `json:"subscription"`
+	// Options are the choices of the current step referenced by index in the callbacks
+	Options []string `json:"options,omitempty"`
+	Page    int      `json:"page,omitempty"`
+}
+
+// filterFlow is the filter wizard: the user picks the criteria step by step and saves the filter
+type filterFlow struct {
+	b *Bot
+}
+
+func (b *Bot) commandFilterHandler(ctx context.Context, chatID int64) {
+	if err := b.startConversation(ctx, chatID, flowFilter); err != nil {
+		b.logger.Error("Error showing filters", "err", err, "chat_id", chatID)
+	}
+}
+
+func (f filterFlow) start(ctx context.Context, conv *conversation) error {
+	w := &filterWizard{}
+	text, keyboard, err := f.b.filterView(ctx, conv.ChatID, w)
+	if err != nil {
+		return err
+	}
+	if err = f.b.SendMessage(ctx, conv.ChatID, text, keyboard); err != nil {
+		return err
+	}
+	return f.store(conv, w)
+}
+
+func (f filterFlow) handleCallback(ctx context.Context, conv *conversation, messageID int, op string,
+	value int64) error {
+	b := f.b
+	chatID := conv.ChatID
+	w, err := f.load(conv)
+	if err != nil {
+		return err
+	}
+	switch filterOp(op) {
+	case filterOpNew:
+		w.Subscription = model.Subscription{ChatID: chatID, Sellers: model.SellerAny}
+		err = b.enterFilterStep(ctx, w, filterStepBrands)
+	case filterOpEdit:
+		w.Subscription, err = b.repo.Subscription(ctx, chatID, value)
+		if err == nil {
+			err = b.enterFilterStep(ctx, w, filterStepBrands)
+		}
+	case filterOpDelete:
+		w.Subscription, err = b.repo.Subscription(ctx, chatID, value)
+		if err == nil {
+			err = b.enterFilterStep(ctx, w, filterStepDelete)
+		}
+	case filterOpRemove:
+		err = b.repo.SubscriptionDelete(ctx, chatID, w.Subscription.ID)
+		if err == nil {
+			err = b.enterFilterStep(ctx, w, filterStepList)
+		}
+	case filterOpToggle:
+		err = w.toggle(int(value))
+	case filterOpPage:
+		w.Page = int(value)
+	case filterOpAny:
+		w.clear()
+	case filterOpNext:
+		err = b.enterFilterStep(ctx, w, w.nextStep())
+	case filterOpBack:
+		err = b.enterFilterStep(ctx, w, w.prevStep())
+	case filterOpSave:
+		if w.Subscription.Name == "" {
+			w.Subscription.Name = filterName(w.Subscription)
+		}
+		_, err = b.repo.SubscriptionSave(ctx, w.Subscription)
+		if err == nil {
+			err = b.enterFilterStep(ctx, w, filterStepList)
+		}
+	case filterOpCancel:
+		conv.done = true
+		return b.editMessage(ctx, chatID, messageID, "Filter editing is cancelled", nil)
+	default:
+		err = fmt.Errorf("unknown filter action %q", op)
+	}
+	if err != nil {
+		return err
+	}
+	text, keyboard, err := b.filterView(ctx, chatID, w)
+	if err != nil {
+		return err
+	}
+	if err = b.editMessage(ctx, chatID, messageID, text, keyboard); err != nil {
+		return err
+	}
+	return f.store(conv, w)
+}
+
+// handleText sets the range of the current step from the message
+func (f filterFlow) handleText(ctx context.Context, conv *conversation, text string) error {
+	b := f.b
+	w, err := f.load(conv)
+	if err != nil {
+		return err
+	}
+	if !w.step.isRange() {
+		b.SendMessage(ctx, conv.ChatID, "Use the buttons above or /cancel", nil)
+		return nil
+	}
+	from, to, err := parseRange(text)
+	if err != nil {
+		b.SendMessage(ctx, conv.ChatID, emojiAlert+" "+err.Error()+". "+rangeHint, nil)
+		return nil
+	}
+	w.setRange(from, to)
+	if err = b.enterFilterStep(ctx, w, w.nextStep()); err != nil {
+		return err
+	}
+	view, keyboard, err := b.filterView(ctx, conv.ChatID, w)
+	if err != nil {
+		return err
+	}
+	if err = b.SendMessage(ctx, conv.ChatID, view, keyboard); err != nil {
+		return err
+	}
+	return f.store(conv, w)
+}
+
+// load returns the wizard of the conversation
+func (f filterFlow) load(conv *conversation) (*filterWizard, error) {
+	w := &filterWizard{step: filterStep(conv.Step)}
+	if err := conv.state(w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// store saves the wizard into the conversation
+func (f filterFlow) store(conv *conversation, w *filterWizard) error {
+	conv.Step = int(w.step)
+	return conv.setState(w)
+}
+
+// enterFilterStep moves the wizard to the step and loads the options of the step
+func (b *Bot) enterFilterStep(ctx context.Context, w *filterWizard, step filterStep) error {
+	w.step = step
+	w.Page = 0
+	w.Options = nil
+	switch step {
+	case filterStepList:
+		w.Subscription = model.Subscription{}
+	case filterStepBrands:
+		for brand := range b.brands.CarBrands() {
+			w.Options = append(w.Options, brand)
+		}
+		// the brands of the edited filter may be not listed at the moment
+		for _, brand := range w.Subscription.Brands {
+			if !slices.Contains(w.Options, brand) {
+				w.Options = append(w.Options, brand)
+			}
+		}
+		sort.Strings(w.Options)
+	case filterStepModels:
+		models, err := b.repo.Models(ctx, w.Subscription.Brands)
+		if err != nil {
+			return fmt.Errorf("error getting models: %w", err)
+		}
+		w.Options = models
+		for _, m := range w.Subscription.Models {
+			if !slices.Contains(w.Options, m) {
+				w.Options = append(w.Options, m)
+			}
+		}
+		sort.Strings(w.Options)
+	case filterStepFuel:
+		for _, fuel := range fuelTypes {
+			w.Options = append(w.Options, string(fuel))
+		}
+	case filterStepGearbox:
+		for _, gearbox := range gearboxes {
+			w.Options = append(w.Options, gearboxName(gearbox))
+		}
+	case filterStepDistricts:
+		w.Options = districts
+	}
+	return nil
+}
+
+// filterView returns the message and the keyboard of the current wizard step
+func (b *Bot) filterView(ctx context.Context, chatID int64, w *filterWizard) (string,
+	*tgbotapi.InlineKeyboardMarkup, error) {
+	s := w.Subscription
+	var text string
+	var rows [][]tgbotapi.InlineKeyboardButton
+	switch w.step {
+	case filterStepList:
+		subscriptions, err := b.repo.Subscriptions(ctx, chatID)
+		if err != nil {
+			return "", nil, fmt.Errorf("error getting subscriptions: %w", err)
+		}
+		text = "<strong>Filters</strong>\n"
+		if len(subscriptions) == 0 {
+			text += "\nNo filters yet, no ads will be sent to you\n"
+		}
+		for _, subscription := range subscriptions {
+			text += "\n" + subscriptionText(subscription)
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				w.button(emojiEdit+" "+subscriptionName(subscription), filterOpEdit, subscription.ID),
+				w.button(emojiDelete+" "+subscriptionName(subscription), filterOpDelete, subscription.ID),
+			))
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(w.button("➕ New filter", filterOpNew, 0)))
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+		return text, &keyboard, nil
+	case filterStepBrands:
+		text = "Select the brands, none means any brand"
+		if len(w.Options) == 0 {
+			text = "The brands are not loaded yet, any brand is selected. Try again later to select brands"
+		}
+		rows = w.optionRows(func(brand string) bool { return slices.Contains(s.Brands, brand) })
+	case filterStepModels:
+		text = "Select the models, none means any model"
+		rows = w.optionRows(func(m string) bool { return slices.Contains(s.Models, m) })
+	case filterStepPrice:
+		text = fmt.Sprintf("Send the price range in euros.\nCurrent: %s", rangeText(s.MinPrice, s.MaxPrice))
+	case filterStepYear:
+		text = fmt.Sprintf("Send the range of the year of manufacture.\nCurrent: %s", rangeText(s.MinYear, s.MaxYear))
+	case filterStepMileage:
+		text = fmt.Sprintf("Send the mileage range in km.\nCurrent: %s", rangeText(s.MinMileage, s.MaxMileage))
+	case filterStepFuel:
+		text = "Select the fuel types, none means any fuel"
+		rows = w.optionRows(func(fuel string) bool { return slices.Contains(s.Fuels, model.FuelType(fuel)) })
+	case filterStepGearbox:
+		text = "Select the gearbox"
+		rows = w.optionRows(func(name string) bool { return gearboxName(s.Gearbox) == name })
+	case filterStepDistricts:
+		text = "Select the districts, none means anywhere"
+		rows = w.optionRows(func(district string) bool { return slices.Contains(s.Districts, district) })
+	case filterStepDelete:
+		text = "Delete the filter?\n\n" + subscriptionText(s)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			w.button("« Back", filterOpBack, 0),
+			w.button(emojiDelete+" Delete", filterOpRemove, 0),
+		))
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+		return text, &keyboard, nil
+	case filterStepReview:
+		text = "Review the filter\n\n" + subscriptionText(s)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			w.button("« Back", filterOpBack, 0),
+			w.button("💾 Save", filterOpSave, 0),
+		), tgbotapi.NewInlineKeyboardRow(w.button("Cancel", filterOpCancel, 0)))
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+		return text, &keyboard, nil
+	}
+	if w.step.isRange() {
+		text += "\n\n" + rangeHint
+	}
+	text = fmt.Sprintf("<strong>Step %d/%d.</strong> %s", w.step, filterStepReview-1, text)
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		w.button("« Back", filterOpBack, 0),
+		w.button("Any", filterOpAny, 0),
+		w.button("Next »", filterOpNext, 0),
+	), tgbotapi.NewInlineKeyboardRow(w.button("Cancel", filterOpCancel, 0)))
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return text, &keyboard, nil
+}
+
+// optionRows returns the keyboard rows of the current page of the options with the paging row
+func (w *filterWizard) optionRows(selected func(option string) bool) [][]tgbotapi.InlineKeyboardButton {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	from := min(w.Page*filterPageSize, len(w.Options))
+	to := min(from+filterPageSize, len(w.Options))
+	for i := from; i < to; i++ {
+		if (i-from)%filterRowSize == 0 {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow())
+		}
+		text := w.Options[i]
+		if selected(text) {
+			text = emojiSelected + " " + text
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], w.button(text, filterOpToggle, int64(i)))
+	}
+	var paging []tgbotapi.InlineKeyboardButton
+	if w.Page > 0 {
+		paging = append(paging, w.button("◀️", filterOpPage, int64(w.Page-1)))
+	}
+	if to < len(w.Options) {
+		paging = append(paging, w.button("▶️", filterOpPage, int64(w.Page+1)))
+	}
+	if len(paging) > 0 {
+		rows = append(rows, paging)
+	}
+	return rows
+}
+
+// button returns the button of the current wizard step
+func (w *filterWizard) button(text string, op filterOp, value int64) tgbotapi.InlineKeyboardButton {
+	return conversationButton(flowFilter, int(w.step), text, string(op), value)
+}
+
+// toggle selects the option of the current step or unselects it if it is selected
+func (w *filterWizard) toggle(index int) error {
+	if index < 0 || index >= len(w.Options) {
+		return errors.New("error to parse option")
+	}
+	option := w.Options[index]
+	s := &w.Subscription
+	switch w.step {
+	case filterStepBrands:
+		s.Brands = toggle(s.Brands, option)
+		w.clearModels()
+	case filterStepModels:
+		s.Models = toggle(s.Models, option)
+	case filterStepFuel:
+		s.Fuels = toggle(s.Fuels, model.FuelType(option))
+	case filterStepGearbox:
+		s.Gearbox = gearboxes[index]
+	case filterStepDistricts:
+		s.Districts = toggle(s.Districts, option)
+	}
+	return nil
+}
+
+// clear resets the criteria of the current step to any
+func (w *filterWizard) clear() {
+	s := &w.Subscription
+	switch w.step {
+	case filterStepBrands:
+		s.Brands = nil
+		w.clearModels()
+	case filterStepModels:
+		s.Models = nil
+	case filterStepFuel:
+		s.Fuels = nil
+	case filterStepGearbox:
+		s.Gearbox = model.GearboxAny
+	case filterStepDistricts:
+		s.Districts = nil
+	default:
+		w.setRange(0, 0)
+	}
+}
+
+// clearModels resets the models if no brands are selected: the models step is skipped then
+// and the models left from the former brands would be a hidden criteria
+func (w *filterWizard) clearModels() {
+	if len(w.Subscription.Brands) == 0 {
+		w.Subscription.Models = nil
+	}
+}
+
+// setRange sets the range of the current step
+func (w *filterWizard) setRange(from, to int) {
+	s := &w.Subscription
+	switch w.step {
+	case filterStepPrice:
+		s.MinPrice, s.MaxPrice = from, to
+	case filterStepYear:
+		s.MinYear, s.MaxYear = from, to
+	case filterStepMileage:
+		s.MinMileage, s.MaxMileage = from, to
+	}
+}
+
+func (w *filterWizard) nextStep() filterStep {
+	// models are chosen among the models of the selected brands
+	if w.step == filterStepBrands && len(w.Subscription.Brands) == 0 {
+		return filterStepPrice
+	}
+	return min(w.step+1, filterStepReview)
+}
+
+func (w *filterWizard) prevStep() filterStep {
+	if w.step == filterStepPrice && len(w.Subscription.Brands) == 0 {
+		return filterStepBrands
+	}
+	if w.step == filterStepDelete {
+		return filterStepList
+	}
+	return max(w.step-1, filterStepList)
+}
+
+func (s filterStep) isRange() bool {
+	return s == filterStepPrice || s == filterStepYear || s == filterStepMileage
+}
+
+const rangeHint = "Send the range like <code>10000-25000</code>, <code>10000-</code> or <code>-25000</code>, " +
+	"or <code>any</code>"
+
+// parseRange parses the range like 10000-25000, 10000- or -25000. Zero bound means no bound.
+func parseRange(text string) (int, int, error) {
+	text = strings.ReplaceAll(strings.TrimSpace(text), " ", "")
+	if strings.EqualFold(text, "any") || text == "-" {
+		return 0, 0, nil
+	}
+	fromText, toText, found := strings.Cut(text, "-")
+	if !found {
+		return 0, 0, errors.New("the range is not recognized")
+	}
+	var from, to int
+	var err error
+	if fromText != "" {
+		if from, err = strconv.Atoi(fromText); err != nil || from < 0 {
+			return 0, 0, errors.New("the lower bound is not a number")
+		}
+	}
+	if toText != "" {
+		if to, err = strconv.Atoi(toText); err != nil || to < 0 {
+			return 0, 0, errors.New("the upper bound is not a number")
+		}
+	}
+	if to != 0 && from > to {
+		return 0, 0, errors.New("the lower bound is greater than the upper one")
+	}
+	return from, to, nil
+}
+
+func rangeText(from, to int) string {
+	switch {
+	case from == 0 && to == 0:
+		return "any"
+	case to == 0:
+		return fmt.Sprintf("from %d", from)
+	case from == 0:
+		return fmt.Sprintf("up to %d", to)
+	}
+	return fmt.Sprintf("%d – %d", from, to)
+}
+
+func gearboxName(gearbox model.Gearbox) string {
+	if gearbox == model.GearboxAny {
+		return "any"
+	}
+	return string(gearbox)
+}
+
+// subscriptionName returns the name of the subscription or its id if it has no name
+func subscriptionName(s model.Subscription) string {
+	if s.Name == "" {
+		return fmt.Sprintf("#%d", s.ID)
+	}
+	return s.Name
+}
+
+// filterName returns the name of the new filter made of its brands
+func filterName(s model.Subscription) string {
+	if len(s.Brands) == 0 {
+		return "All brands"
+	}
+	if len(s.Brands) > maxFilterNameBrands {
+		return strings.Join(s.Brands[:maxFilterNameBrands], ", ") + fmt.Sprintf(" +%d",
+			len(s.Brands)-maxFilterNameBrands)
+	}
+	return strings.Join(s.Brands, ", ")
+}
+
+// toggle removes the item from the list if it is there or adds it otherwise
+func toggle[T comparable](items []T, item T) []T {
+	if i := slices.Index(items, item); i >= 0 {
+		return slices.Delete(items, i, i+1)
+	}
+	return append(items, item)
+}
@@ -0,0 +1,99 @@
+package bot
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		text     string
+		from, to int
+		err      bool
+	}{
+		{"10000-25000", 10000, 25000, false},
+		{" 10 000 - 25 000 ", 10000, 25000, false},
+		{"2018-", 2018, 0, false},
+		{"-50000", 0, 50000, false},
+		{"Any", 0, 0, false},
+		{"-", 0, 0, false},
+		{"25000-10000", 0, 0, true},
+		{"cheap", 0, 0, true},
+		{"10k-20k", 0, 0, true},
+	}
+	for _, tt := range tests {
+		from, to, err := parseRange(tt.text)
+		if tt.err {
+			assert.Error(t, err, tt.text)
+			continue
+		}
+		assert.NoError(t, err, tt.text)
+		assert.Equal(t, tt.from, from, tt.text)
+		assert.Equal(t, tt.to, to, tt.text)
+	}
+}
+
+func TestFilterWizardSteps(t *testing.T) {
+	w := &filterWizard{step: filterStepBrands, Options: []string{"Audi", "BMW"}}
+	// models are skipped without brands
+	assert.Equal(t, filterStepPrice, w.nextStep())
+
+	assert.NoError(t, w.toggle(1))
+	assert.Equal(t, []string{"BMW"}, w.Subscription.Brands)
+	assert.Equal(t, filterStepModels, w.nextStep())
+	assert.Error(t, w.toggle(2))
+
+	w.step = filterStepPrice
+	assert.Equal(t, filterStepModels, w.prevStep())
+	w.setRange(10000, 25000)
+	assert.Equal(t, 10000, w.Subscription.MinPrice)
+	assert.Equal(t, 25000, w.Subscription.MaxPrice)
+	w.clear()
+	assert.Equal(t, 0, w.Subscription.MaxPrice)
+
+	// the models are reset once no brand is selected
+	w.step = filterStepBrands
+	w.Subscription.Models = []string{"X5"}
+	assert.NoError(t, w.toggle(0))
+	assert.Equal(t, []string{"BMW", "Audi"}, w.Subscription.Brands)
+	assert.Equal(t, []string{"X5"}, w.Subscription.Models)
+	assert.NoError(t, w.toggle(0))
+	assert.NoError(t, w.toggle(1))
+	assert.Empty(t, w.Subscription.Brands)
+	assert.Nil(t, w.Subscription.Models)
+	assert.Equal(t, filterStepPrice, w.nextStep())
+	w.Subscription.Brands = []string{"Audi"}
+	w.Subscription.Models = []string{"A4"}
+	w.clear()
+	assert.Nil(t, w.Subscription.Models)
+
+	w.step = filterStepDelete
+	assert.Equal(t, filterStepList, w.prevStep())
+
+	w.step = filterStepGearbox
+	w.Options = []string{"any", "automatic", "manual"}
+	assert.NoError(t, w.toggle(1))
+	assert.Equal(t, model.GearboxAutomatic, w.Subscription.Gearbox)
+	assert.Equal(t, filterStepDistricts, w.nextStep())
+}
+
+func TestFilterName(t *testing.T) {
+	assert.Equal(t, "All brands", filterName(model.Subscription{}))
+	assert.Equal(t, "Audi, BMW", filterName(model.Subscription{Brands: []string{"Audi", "BMW"}}))
+	assert.Equal(t, "Audi, BMW, Ford +2",
+		filterName(model.Subscription{Brands: []string{"Audi", "BMW", "Ford", "Honda", "Mazda"}}))
+}
+
+func TestFilterFlowState(t *testing.T) {
+	f := filterFlow{}
+	conv := &conversation{Conversation: model.Conversation{ChatID: 1, Flow: string(flowFilter)}}
+	w := &filterWizard{step: filterStepFuel, Options: []string{"Petrol", "Diesel"}, Page: 1,
+		Subscription: model.Subscription{ID: 5, Brands: []string{"BMW"}, MaxPrice: 30000}}
+	assert.NoError(t, f.store(conv, w))
+	assert.Equal(t, int(filterStepFuel), conv.Step)
+
+	loaded, err := f.load(conv)
+	assert.NoError(t, err)
+	assert.Equal(t, w, loaded)
+}
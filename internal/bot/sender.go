@@ -0,0 +1,154 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/bopoh24/bazacars/internal/config"
+	"github.com/bopoh24/bazacars/pkg/ratelimit"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRetryAfter is the delay after 429 response without retry_after
+const defaultRetryAfter = time.Second
+
+// SendStats is the statistics of the requests sent to telegram
+type SendStats struct {
+	Sent   int64
+	Failed int64
+	// RateLimited is the number of 429 responses
+	RateLimited int64
+	// Waited is the total time the requests waited for the rate limits
+	Waited time.Duration
+}
+
+// sender makes the requests to telegram within the global and per chat rate limits.
+// All requests of the bot go through it.
+type sender struct {
+	global     *ratelimit.TokenBucket
+	chatRate   float64
+	chatBurst  int
+	maxRetries int
+
+	mu          sync.Mutex
+	chats       map[int64]*ratelimit.TokenBucket
+	pausedUntil time.Time
+
+	sent        atomic.Int64
+	failed      atomic.Int64
+	rateLimited atomic.Int64
+	waited      atomic.Int64
+}
+
+func newSender(conf config.Telegram) *sender {
+	return &sender{
+		global:     ratelimit.NewTokenBucket(conf.Rate, conf.Burst),
+		chatRate:   conf.ChatRate,
+		chatBurst:  conf.ChatBurst,
+		maxRetries: conf.MaxRetries,
+		chats:      make(map[int64]*ratelimit.TokenBucket),
+	}
+}
+
+// send makes the request counted as cost messages to the chat. Zero chat id means the request is not
+// a message to a chat and is limited globally only. The request rejected with 429 is retried after
+// the retry_after delay, all the requests are paused meanwhile.
+func (s *sender) send(ctx context.Context, chatID int64, cost int, request func() error) error {
+	for attempt := 0; ; attempt++ {
+		started := time.Now()
+		if err := s.wait(ctx, chatID, cost); err != nil {
+			s.failed.Add(1)
+			return err
+		}
+		s.waited.Add(int64(time.Since(started)))
+
+		err := request()
+		if err == nil {
+			s.sent.Add(1)
+			return nil
+		}
+		delay := retryAfter(err)
+		if delay > 0 {
+			s.rateLimited.Add(1)
+			s.pause(delay)
+		}
+		if delay == 0 || attempt >= s.maxRetries {
+			s.failed.Add(1)
+			return err
+		}
+	}
+}
+
+// stats returns the statistics of the sent requests
+func (s *sender) stats() SendStats {
+	return SendStats{
+		Sent:        s.sent.Load(),
+		Failed:      s.failed.Load(),
+		RateLimited: s.rateLimited.Load(),
+		Waited:      time.Duration(s.waited.Load()),
+	}
+}
+
+// wait blocks until the request is allowed by the limits and the pause is over
+func (s *sender) wait(ctx context.Context, chatID int64, cost int) error {
+	for i := 0; i < max(cost, 1); i++ {
+		if chatID != 0 {
+			if err := s.chat(chatID).Wait(ctx); err != nil {
+				return err
+			}
+		}
+		if err := s.global.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	for {
+		s.mu.Lock()
+		delay := time.Until(s.pausedUntil)
+		s.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// pause stops sending for the delay
+func (s *sender) pause(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until := time.Now().Add(delay); until.After(s.pausedUntil) {
+		s.pausedUntil = until
+	}
+}
+
+func (s *sender) chat(chatID int64) *ratelimit.TokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.chats[chatID]
+	if !ok {
+		bucket = ratelimit.NewTokenBucket(s.chatRate, s.chatBurst)
+		s.chats[chatID] = bucket
+	}
+	return bucket
+}
+
+// retryAfter returns the delay requested by 429 response or zero if the error is not 429
+func retryAfter(err error) time.Duration {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) || tgErr.Code != http.StatusTooManyRequests {
+		return 0
+	}
+	if tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second
+	}
+	return defaultRetryAfter
+}
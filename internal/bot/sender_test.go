@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/bopoh24/bazacars/internal/config"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSenderChatLimit(t *testing.T) {
+	s := newSender(config.Telegram{Rate: 1000, Burst: 10, ChatRate: 50, ChatBurst: 1})
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, s.send(context.Background(), 1, 1, func() error { return nil }))
+	}
+	// one message from chat burst and two more at 50 per second
+	assert.GreaterOrEqual(t, time.Since(started), 35*time.Millisecond)
+
+	// other chats are not limited by the first one
+	started = time.Now()
+	assert.NoError(t, s.send(context.Background(), 2, 1, func() error { return nil }))
+	assert.Less(t, time.Since(started), 15*time.Millisecond)
+	assert.Equal(t, int64(4), s.stats().Sent)
+}
+
+func TestSenderRetryAfter(t *testing.T) {
+	s := newSender(config.Telegram{Rate: 1000, Burst: 10, ChatRate: 1000, ChatBurst: 10, MaxRetries: 2})
+	calls := 0
+	started := time.Now()
+	err := s.send(context.Background(), 1, 1, func() error {
+		calls++
+		if calls == 1 {
+			return &tgbotapi.Error{Code: http.StatusTooManyRequests,
+				ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 1}}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.GreaterOrEqual(t, time.Since(started), time.Second)
+	stats := s.stats()
+	assert.Equal(t, int64(1), stats.Sent)
+	assert.Equal(t, int64(1), stats.RateLimited)
+	assert.GreaterOrEqual(t, stats.Waited, time.Second)
+}
+
+func TestSenderDoesNotRetryOtherErrors(t *testing.T) {
+	s := newSender(config.Telegram{Rate: 1000, Burst: 10, ChatRate: 1000, ChatBurst: 10, MaxRetries: 2})
+	calls := 0
+	err := s.send(context.Background(), 1, 1, func() error {
+		calls++
+		return &tgbotapi.Error{Code: http.StatusForbidden, Message: "bot was blocked by the user"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, int64(1), s.stats().Failed)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), retryAfter(errors.New("network error")))
+	assert.Equal(t, defaultRetryAfter, retryAfter(&tgbotapi.Error{Code: http.StatusTooManyRequests}))
+	assert.Equal(t, 5*time.Second, retryAfter(&tgbotapi.Error{Code: http.StatusTooManyRequests,
+		ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}))
+}
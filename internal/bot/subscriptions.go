@@ -0,0 +1,81 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
+	"html"
+	"strings"
+)
+
+func (b *Bot) commandSubscriptionsHandler(ctx context.Context, chatID int64) {
+	subscriptions, err := b.repo.Subscriptions(ctx, chatID)
+	if err != nil {
+		b.logger.Error("Error getting subscriptions", "err", err, "chat_id", chatID)
+		return
+	}
+	if len(subscriptions) == 0 {
+		b.SendMessage(ctx, chatID, "You have no subscriptions, no ads will be sent to you", nil)
+		return
+	}
+	text := "<strong>Subscriptions:</strong>\n"
+	for _, subscription := range subscriptions {
+		text += "\n" + subscriptionText(subscription)
+	}
+	b.SendMessage(ctx, chatID, text, nil)
+}
+
+// subscriptionText returns the criteria of the subscription, one per line
+func subscriptionText(s model.Subscription) string {
+	lines := []string{"<strong>" + html.EscapeString(subscriptionName(s)) + "</strong>"}
+	addList := func(title string, items []string) {
+		if len(items) > 0 {
+			lines = append(lines, title+": "+html.EscapeString(strings.Join(items, ", ")))
+		}
+	}
+	addList("Brands", s.Brands)
+	addList("Except brands", s.ExcludeBrands)
+	addList("Models", s.Models)
+	addList("Except models", s.ExcludeModels)
+	addRange := func(title string, from, to any, zero bool, unit string) {
+		switch {
+		case zero:
+		case from == to:
+			lines = append(lines, fmt.Sprintf("%s: %v%s", title, from, unit))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %v – %v%s", title, from, to, unit))
+		}
+	}
+	addRange("Price", rangeBound(s.MinPrice), rangeBound(s.MaxPrice), s.MinPrice == 0 && s.MaxPrice == 0, "€")
+	addRange("Year", rangeBound(s.MinYear), rangeBound(s.MaxYear), s.MinYear == 0 && s.MaxYear == 0, "")
+	addRange("Mileage", rangeBound(s.MinMileage), rangeBound(s.MaxMileage),
+		s.MinMileage == 0 && s.MaxMileage == 0, "km")
+	addRange("Engine", rangeBound(s.MinEngine), rangeBound(s.MaxEngine), s.MinEngine == 0 && s.MaxEngine == 0, "L")
+	addList("Fuel", stringsOf(s.Fuels))
+	if s.Gearbox != model.GearboxAny {
+		lines = append(lines, "Gearbox: "+string(s.Gearbox))
+	}
+	addList("Drive", stringsOf(s.Drives))
+	addList("Districts", s.Districts)
+	if s.Sellers != "" && s.Sellers != model.SellerAny {
+		lines = append(lines, "Sellers: "+string(s.Sellers))
+	}
+	addList("Equipment", stringsOf(s.Equipment))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// rangeBound returns the bound for display, zero bound is shown as any
+func rangeBound[T int | float64](bound T) any {
+	if bound == 0 {
+		return "any"
+	}
+	return bound
+}
+
+func stringsOf[T ~string](items []T) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, string(item))
+	}
+	return result
+}
@@ -0,0 +1,157 @@
+package fingerprint
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/pkg/imagehash"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Threshold is the minimal score of two ads of the same vehicle
+	Threshold = 0.7
+
+	// maxEngineDiff is the maximal difference of the engine sizes of the same vehicle
+	maxEngineDiff = 0.1
+	// maxMileageDiff is the maximal difference of the mileages of the same vehicle in km
+	maxMileageDiff = 20000
+	// MaxPhotoDistance is the maximal hamming distance of the hashes of the same photo
+	MaxPhotoDistance = 10
+	// minWordLength is the length of the shortest description word compared
+	minWordLength = 3
+
+	weightMileage     = 0.25
+	weightColor       = 0.1
+	weightSeller      = 0.2
+	weightDescription = 0.3
+	weightPhotos      = 0.35
+)
+
+// Match is the candidate ad with its similarity score
+type Match struct {
+	Car   model.Car
+	Score float64
+}
+
+// BestMatch returns the candidate most similar to the car if its score is at least Threshold
+func BestMatch(car model.Car, candidates []model.Car) (Match, bool) {
+	var best Match
+	for _, candidate := range candidates {
+		if candidate.AdID == car.AdID {
+			continue
+		}
+		if score := Score(car, candidate); score > best.Score {
+			best = Match{Car: candidate, Score: score}
+		}
+	}
+	return best, best.Score >= Threshold
+}
+
+// Score returns the similarity of the ads from 0 to 1. It is 0 if the ads can't be the same vehicle:
+// manufacturer, model, year, engine, fuel and gearbox must match and mileage must be close.
+// The rest of the attributes are weighted, the ones unknown for any of the ads are not counted.
+// The score is 0 unless photos or description are known for both ads: mileage, color and seller
+// alone are shared by too many cars of the same model, e.g. of a dealer.
+func Score(a, b model.Car) float64 {
+	if !strings.EqualFold(a.Manufacturer, b.Manufacturer) || !strings.EqualFold(a.Model, b.Model) ||
+		a.Year != b.Year || a.AutomaticGearbox != b.AutomaticGearbox ||
+		math.Abs(a.EngineSize-b.EngineSize) > maxEngineDiff {
+		return 0
+	}
+	if a.Fuel != "" && b.Fuel != "" && a.Fuel != b.Fuel {
+		return 0
+	}
+	mileageDiff := abs(a.Mileage - b.Mileage)
+	if mileageDiff > maxMileageDiff {
+		return 0
+	}
+
+	var score, weights float64
+	add := func(weight, similarity float64) {
+		score += weight * similarity
+		weights += weight
+	}
+	add(weightMileage, 1-float64(mileageDiff)/maxMileageDiff)
+	if a.Color != "" && b.Color != "" {
+		add(weightColor, equal(strings.EqualFold(a.Color, b.Color)))
+	}
+	if a.Seller.Link != "" && b.Seller.Link != "" {
+		add(weightSeller, equal(a.Seller.Link == b.Seller.Link))
+	}
+	weak := weights
+	if similarity, ok := DescriptionSimilarity(a.Description, b.Description); ok {
+		add(weightDescription, similarity)
+	}
+	if similarity, ok := PhotoSimilarity(a.PhotoHashes, b.PhotoHashes); ok {
+		add(weightPhotos, similarity)
+	}
+	if weights == weak {
+		return 0
+	}
+	return score / weights
+}
+
+// DescriptionSimilarity returns the Jaccard similarity of the description word sets.
+// It returns false if any of the descriptions has no words.
+func DescriptionSimilarity(a, b string) (float64, bool) {
+	wordsA, wordsB := words(a), words(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0, false
+	}
+	common := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(wordsA)+len(wordsB)-common), true
+}
+
+// PhotoSimilarity returns the share of the photos of the ad with fewer photos
+// which have a close photo in the other ad. It returns false if any of the ads has no photo hashes.
+func PhotoSimilarity(a, b []uint64) (float64, bool) {
+	if len(a) == 0 || len(b) == 0 {
+		return 0, false
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	matched := 0
+	for _, hashA := range a {
+		for _, hashB := range b {
+			if imagehash.Distance(hashA, hashB) <= MaxPhotoDistance {
+				matched++
+				break
+			}
+		}
+	}
+	return float64(matched) / float64(len(a)), true
+}
+
+// words returns the set of lower case words of the text
+func words(text string) map[string]bool {
+	result := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(word)) >= minWordLength {
+			result[word] = true
+		}
+	}
+	return result
+}
+
+func equal(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,116 @@
+package fingerprint
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testCar(adID string) model.Car {
+	return model.Car{
+		AdID:             adID,
+		Manufacturer:     "Toyota",
+		Model:            "Corolla",
+		Year:             2018,
+		Mileage:          85000,
+		EngineSize:       1.6,
+		Fuel:             model.FuelTypePetrol,
+		AutomaticGearbox: true,
+		Color:            "White",
+		Seller:           model.Seller{Link: "/c/u/john/"},
+		Description:      "Excellent condition, one owner, full service history, new tyres",
+	}
+}
+
+func TestScore(t *testing.T) {
+	original := testCar("1")
+
+	repost := testCar("2")
+	repost.Mileage = 85500
+	repost.Description = "Excellent condition! One owner, full service history"
+	assert.GreaterOrEqual(t, Score(original, repost), Threshold)
+
+	// hard constraints
+	other := testCar("3")
+	other.Year = 2019
+	assert.Zero(t, Score(original, other))
+	other = testCar("3")
+	other.EngineSize = 1.8
+	assert.Zero(t, Score(original, other))
+	other = testCar("3")
+	other.Mileage = 150000
+	assert.Zero(t, Score(original, other))
+
+	// same model of another seller with another description
+	other = testCar("3")
+	other.Seller.Link = "/c/u/ann/"
+	other.Color = "Black"
+	other.Mileage = 95000
+	other.Description = "Urgent sale, price negotiable"
+	assert.Less(t, Score(original, other), Threshold)
+}
+
+func TestScoreWithoutStrongSignal(t *testing.T) {
+	original := testCar("1")
+	original.Seller.Link = ""
+	original.Description = ""
+
+	// another car of the same model with close mileage and the same color
+	other := testCar("2")
+	other.Seller.Link = ""
+	other.Description = ""
+	other.Mileage = 90000
+	assert.Zero(t, Score(original, other))
+
+	other.Color = ""
+	assert.Zero(t, Score(original, other))
+
+	// another car of the same model of the same dealer
+	other.Seller.Link = "/c/u/john/"
+	original.Seller.Link = "/c/u/john/"
+	assert.Zero(t, Score(original, other))
+
+	other.Description = "Excellent condition, one owner, full service history"
+	original.Description = "Excellent condition! One owner, full service history, new tyres"
+	assert.GreaterOrEqual(t, Score(original, other), Threshold)
+}
+
+func TestScorePhotos(t *testing.T) {
+	original := testCar("1")
+	original.PhotoHashes = []uint64{0xF0F0F0F0F0F0F0F0, 0x0F0F0F0F0F0F0F0F}
+
+	// same photos with compression noise reposted by another account
+	repost := testCar("2")
+	repost.Seller.Link = "/c/u/john2/"
+	repost.Description = ""
+	repost.PhotoHashes = []uint64{0x0F0F0F0F0F0F0F0E, 0xF0F0F0F0F0F0F0F1, 0x1234567812345678}
+	assert.GreaterOrEqual(t, Score(original, repost), Threshold)
+
+	repost.PhotoHashes = []uint64{0x1234567812345678}
+	assert.Less(t, Score(original, repost), Threshold)
+}
+
+func TestBestMatch(t *testing.T) {
+	car := testCar("1")
+	far := testCar("2")
+	far.Mileage = 100000
+	far.Description = "Urgent sale"
+	near := testCar("3")
+	self := testCar("1")
+
+	match, ok := BestMatch(car, []model.Car{far, near, self})
+	assert.True(t, ok)
+	assert.Equal(t, "3", match.Car.AdID)
+
+	_, ok = BestMatch(car, []model.Car{far, self})
+	assert.False(t, ok)
+}
+
+func TestDescriptionSimilarity(t *testing.T) {
+	similarity, ok := DescriptionSimilarity("Full service history", "full SERVICE history!")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, similarity)
+
+	_, ok = DescriptionSimilarity("", "full service history")
+	assert.False(t, ok)
+}
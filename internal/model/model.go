@@ -2,6 +2,8 @@ package model
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -9,6 +11,24 @@ type DriveType string
 
 type FuelType string
 
+type BodyType string
+
+type Condition string
+
+type Equipment string
+
+// SellerFilter defines which sellers are acceptable
+type SellerFilter string
+
+// Gearbox defines which gearbox is acceptable
+type Gearbox string
+
+// CrawlMode defines how brand listings are crawled
+type CrawlMode string
+
+// CrawlStatus is the state of a crawl run or of a brand within the run
+type CrawlStatus string
+
 const (
 	DriveTypeFront DriveType = "FWD"
 	DriveTypeRear  DriveType = "RWD"
@@ -22,40 +42,510 @@ const (
 	FuelTypeHybridPetrol       FuelType = "Hybrid Petrol"
 	FuelTypeElectric           FuelType = "Electric"
 	FuelTypeLPG                FuelType = "LPG"
+
+	BodyTypeSaloon      BodyType = "Saloon"
+	BodyTypeHatchback   BodyType = "Hatchback"
+	BodyTypeEstate      BodyType = "Estate"
+	BodyTypeSUV         BodyType = "SUV"
+	BodyTypeCoupe       BodyType = "Coupe"
+	BodyTypeConvertible BodyType = "Convertible"
+	BodyTypeMinivan     BodyType = "Minivan"
+	BodyTypePickup      BodyType = "Pickup"
+
+	ConditionNew  Condition = "New"
+	ConditionUsed Condition = "Used"
+
+	EquipmentAlloyWheels      Equipment = "Alloy wheels"
+	EquipmentCruiseControl    Equipment = "Cruise control"
+	EquipmentAdaptiveCruise   Equipment = "Adaptive cruise control"
+	EquipmentRearCamera       Equipment = "Rear view camera"
+	EquipmentCamera360        Equipment = "360 camera"
+	EquipmentStartStop        Equipment = "Start/stop"
+	EquipmentSunroof          Equipment = "Sunroof"
+	EquipmentPanoramicRoof    Equipment = "Panoramic roof"
+	EquipmentAndroidAuto      Equipment = "Android Auto"
+	EquipmentAppleCarPlay     Equipment = "Apple CarPlay"
+	EquipmentFoldingMirrors   Equipment = "Folding mirrors"
+	EquipmentLeatherSeats     Equipment = "Leather seats"
+	EquipmentHeatedSeats      Equipment = "Heated seats"
+	EquipmentElectricSeats    Equipment = "Electric seats"
+	EquipmentParkingSensors   Equipment = "Parking sensors"
+	EquipmentLaneAssist       Equipment = "Lane assist"
+	EquipmentBlindSpotMonitor Equipment = "Blind spot monitor"
+	EquipmentNavigation       Equipment = "Navigation"
+	EquipmentBluetooth        Equipment = "Bluetooth"
+	EquipmentKeyless          Equipment = "Keyless entry"
+	EquipmentClimateControl   Equipment = "Climate control"
+	EquipmentLEDHeadlights    Equipment = "LED headlights"
+	EquipmentXenonHeadlights  Equipment = "Xenon headlights"
+	EquipmentHeadUpDisplay    Equipment = "Head-up display"
+	EquipmentTowBar           Equipment = "Tow bar"
+	EquipmentElectricTailgate Equipment = "Electric tailgate"
+	EquipmentWirelessCharging Equipment = "Wireless charging"
+	EquipmentPremiumSound     Equipment = "Premium sound system"
+
+	SellerAny     SellerFilter = "any"
+	SellerDealer  SellerFilter = "dealer"
+	SellerPrivate SellerFilter = "private"
+
+	GearboxAny       Gearbox = ""
+	GearboxAutomatic Gearbox = "automatic"
+	GearboxManual    Gearbox = "manual"
+
+	// CrawlModeFull walks all listing pages of every brand
+	CrawlModeFull CrawlMode = "full"
+	// CrawlModeFresh walks the newest ads of every brand until it reaches already known ones
+	CrawlModeFresh CrawlMode = "fresh"
+
+	CrawlStatusPending   CrawlStatus = "pending"
+	CrawlStatusRunning   CrawlStatus = "running"
+	CrawlStatusCompleted CrawlStatus = "completed"
+	CrawlStatusFailed    CrawlStatus = "failed"
 )
 
+// CrawlRun is a crawl of all brands with per-brand progress
+type CrawlRun struct {
+	ID         int64
+	Mode       CrawlMode
+	Day        time.Time
+	Status     CrawlStatus
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Brands     []CrawlBrand
+}
+
+// CrawlBrand is the progress of a brand within the crawl run
+type CrawlBrand struct {
+	Brand      string
+	Status     CrawlStatus
+	TotalPages int
+	LastPage   int
+	Error      string
+	UpdatedAt  time.Time
+	CrawlStats
+}
+
+// CrawlStats are the counters of the crawl
+type CrawlStats struct {
+	Pages     int
+	Parsed    int
+	New       int
+	Updated   int
+	Unchanged int
+	Failed    int
+	Forbidden int
+	Requests  int
+	Duration  time.Duration
+}
+
+// Rate returns the effective request rate per second, 0 if there is no duration
+func (s CrawlStats) Rate() float64 {
+	return rate(s.Requests, s.Duration)
+}
+
+// Add adds the counters of other to the stats
+func (s *CrawlStats) Add(other CrawlStats) {
+	s.Pages += other.Pages
+	s.Parsed += other.Parsed
+	s.New += other.New
+	s.Updated += other.Updated
+	s.Unchanged += other.Unchanged
+	s.Failed += other.Failed
+	s.Forbidden += other.Forbidden
+	s.Requests += other.Requests
+	s.Duration += other.Duration
+}
+
+// Brand returns the progress of the brand and true if the brand is in the run
+func (r CrawlRun) Brand(brand string) (CrawlBrand, bool) {
+	for _, b := range r.Brands {
+		if b.Brand == brand {
+			return b, true
+		}
+	}
+	return CrawlBrand{}, false
+}
+
+// Stats returns the sum of the brand stats of the run
+func (r CrawlRun) Stats() CrawlStats {
+	var stats CrawlStats
+	for _, b := range r.Brands {
+		stats.Add(b.CrawlStats)
+	}
+	return stats
+}
+
+// FailedBrands returns the number of brands failed to crawl
+func (r CrawlRun) FailedBrands() int {
+	failed := 0
+	for _, b := range r.Brands {
+		if b.Status == CrawlStatusFailed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Duration returns the wall time of the run, up to now if the run is not finished
+func (r CrawlRun) Duration() time.Duration {
+	if r.FinishedAt.IsZero() {
+		return time.Since(r.StartedAt)
+	}
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+// Rate returns the effective request rate per second of the run.
+// The brands are crawled concurrently, so the requests of all brands are divided by the run duration.
+func (r CrawlRun) Rate() float64 {
+	return rate(r.Stats().Requests, r.Duration())
+}
+
+func rate(requests int, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(requests) / duration.Seconds()
+}
+
+// RemovedAd is the last snapshot of the ad which disappeared from the listings
+type RemovedAd struct {
+	Car
+	ListedSince time.Time
+	LastSeen    time.Time
+	RemovedOn   time.Time
+	DaysListed  int
+}
+
+// Seller of the ad
+type Seller struct {
+	Name     string `json:"name"`
+	Verified bool   `json:"verified"`
+	Dealer   bool   `json:"dealer"`
+	Link     string `json:"link"`
+}
+
+// AdSummary is the ad data available on the list page
+type AdSummary struct {
+	AdID   string    `json:"ad_id"`
+	Link   string    `json:"link"`
+	Title  string    `json:"title"`
+	Price  int       `json:"price"`
+	Posted time.Time `json:"posted"`
+	Seller Seller    `json:"seller"`
+}
+
 type Car struct {
-	Manufacturer     string    `json:"manufacturer"`
-	Model            string    `json:"model"`
-	Year             int       `json:"year"`
-	Mileage          int       `json:"mileage"`
-	EngineSize       float64   `json:"engine"`
-	Fuel             FuelType  `json:"fuel"`
-	Drive            DriveType `json:"drive"`
-	AutomaticGearbox bool      `json:"automatic"`
-	Power            int       `json:"power"`
-	Color            string    `json:"color"`
-	Price            int       `json:"price"`
-	OldPrice         int       `json:"old_price,omitempty"`
-	Description      string    `json:"description"`
-	AdID             string    `json:"ad_id"`
-	Link             string    `json:"link"`
-	Posted           time.Time `json:"posted"`
-	Address          string    `json:"address"`
-	Parsed           time.Time `json:"parsed"`
-	Sent             bool      `json:"sent"`
+	Manufacturer     string      `json:"manufacturer"`
+	Model            string      `json:"model"`
+	Year             int         `json:"year"`
+	Mileage          int         `json:"mileage"`
+	EngineSize       float64     `json:"engine"`
+	Fuel             FuelType    `json:"fuel"`
+	Drive            DriveType   `json:"drive"`
+	AutomaticGearbox bool        `json:"automatic"`
+	Power            int         `json:"power"`
+	Color            string      `json:"color"`
+	Doors            int         `json:"doors"`
+	Seats            int         `json:"seats"`
+	BodyType         BodyType    `json:"body_type"`
+	Condition        Condition   `json:"condition"`
+	MOTTill          time.Time   `json:"mot_till"`
+	Availability     string      `json:"availability"`
+	Equipment        []Equipment `json:"equipment,omitempty"`
+	Photos           []string    `json:"photos,omitempty"`
+	Seller           Seller      `json:"seller"`
+	Price            int         `json:"price"`
+	OldPrice         int         `json:"old_price,omitempty"`
+	Description      string      `json:"description"`
+	AdID             string      `json:"ad_id"`
+	Link             string      `json:"link"`
+	Posted           time.Time   `json:"posted"`
+	Address          string      `json:"address"`
+	Parsed           time.Time   `json:"parsed"`
+	PhotoHashes      []uint64    `json:"-"`
+	VehicleID        int64       `json:"vehicle_id,omitempty"`
+	// Previous is the earlier listing of the same vehicle if the ad is a repost
+	Previous PreviousListing `json:"previous,omitempty"`
+}
+
+// PricePoint is the price of the ad since the date
+type PricePoint struct {
+	Date  time.Time
+	Price int
+}
+
+// PhotoHash is the perceptual hashes of the ad photo
+type PhotoHash struct {
+	Position int
+	URL      string
+	DHash    uint64
+	PHash    uint64
+}
+
+// PreviousListing is the earlier listing of the vehicle under other ad ids
+type PreviousListing struct {
+	AdID  string    `json:"ad_id"`
+	Since time.Time `json:"since"`
+	Price int       `json:"price"`
+}
+
+// DeliveryEvent is the kind of the notification about the ad
+type DeliveryEvent string
+
+const (
+	DeliveryNewAd        DeliveryEvent = "new"
+	DeliveryPriceChanged DeliveryEvent = "price"
+	DeliveryRemoved      DeliveryEvent = "removed"
+	// DeliveryDigest is the digest of the other notifications, it is not about a single ad
+	DeliveryDigest DeliveryEvent = "digest"
+)
+
+// DeliveryStatus is the result of the notification sending
+type DeliveryStatus string
+
+const (
+	DeliverySent   DeliveryStatus = "sent"
+	DeliveryFailed DeliveryStatus = "failed"
+	// DeliveryAssumed is the delivery of the ad sent before the deliveries were tracked. The ad was sent
+	// to every approved user, it is taken as delivered to the users whose subscription matches it.
+	DeliveryAssumed DeliveryStatus = "assumed"
+)
+
+// Delivery is the notification about the ad sent to the user
+type Delivery struct {
+	ChatID      int64
+	AdID        string
+	Event       DeliveryEvent
+	Status      DeliveryStatus
+	Error       string
+	DeliveredAt time.Time
+}
+
+// OutboxStatus is the state of the notification in the outbox
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSent    OutboxStatus = "sent"
+	OutboxFailed  OutboxStatus = "failed"
+	// OutboxHeld is the notification waiting for the digest of the user
+	OutboxHeld OutboxStatus = "held"
+	// OutboxBundled is the notification included into the digest, it gets the status of the digest once sent
+	OutboxBundled OutboxStatus = "bundled"
+)
+
+// OutboxJob is the notification about the ad waiting to be delivered to the user
+type OutboxJob struct {
+	ID int64
+	// Key identifies the notification, the job with the same key is enqueued once
+	Key           string
+	ChatID        int64
+	AdID          string
+	Event         DeliveryEvent
+	Text          string
+	Photos        []string
+	Status        OutboxStatus
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	// Brand, Summary and PriceChange describe the notification in the digest
+	Brand       string
+	Summary     string
+	PriceChange int
+	// Bundle is the ids of the held notifications the digest consists of
+	Bundle []int64
+}
+
+// Delivery returns the delivery of the sent or failed notification
+func (j OutboxJob) Delivery(at time.Time) Delivery {
+	delivery := Delivery{
+		ChatID:      j.ChatID,
+		AdID:        j.AdID,
+		Event:       j.Event,
+		Status:      DeliverySent,
+		Error:       j.LastError,
+		DeliveredAt: at,
+	}
+	if j.Status == OutboxFailed {
+		delivery.Status = DeliveryFailed
+	}
+	return delivery
+}
+
+// OutboxKey returns the key of the notification about the ad event for the chat.
+// The version distinguishes the events which may happen again, like the price change.
+func OutboxKey(event DeliveryEvent, chatID int64, adID string, version ...any) string {
+	key := fmt.Sprintf("%s:%d:%s", event, chatID, adID)
+	for _, v := range version {
+		key += fmt.Sprintf(":%v", v)
+	}
+	return key
+}
+
+// Conversation is the state of the multi-step interaction of the user with the bot
+type Conversation struct {
+	ChatID int64
+	// Flow is the kind of the interaction and Step is the flow specific step
+	Flow string
+	Step int
+	// Data is the JSON state of the flow
+	Data      []byte
+	ExpiresAt time.Time
+	UpdatedAt time.Time
+}
+
+// Subscription is the search criteria of the user. Empty lists and zero bounds match any car.
+type Subscription struct {
+	ID            int64
+	ChatID        int64
+	Name          string
+	Brands        []string
+	ExcludeBrands []string
+	Models        []string
+	ExcludeModels []string
+	MinPrice      int
+	MaxPrice      int
+	MinYear       int
+	MaxYear       int
+	MinMileage    int
+	MaxMileage    int
+	MinEngine     float64
+	MaxEngine     float64
+	Fuels         []FuelType
+	Gearbox       Gearbox
+	Drives        []DriveType
+	Districts     []string
+	Sellers       SellerFilter
+	Equipment     []Equipment
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
+// DefaultSubscription returns the subscription created for the approved user who has none
+func DefaultSubscription(chatID int64) Subscription {
+	return Subscription{
+		ChatID: chatID,
+		Name:   "Default",
+		Brands: []string{"BMW", "Mercedes-Benz", "Mazda", "Toyota", "Nissan", "Audi", "Volkswagen", "Ford", "Honda",
+			"Lexus", "Jeep", "Volvo", "Infiniti", "Acura", "Land Rover", "Jaguar", "Mini"},
+		ExcludeModels: []string{"Fit", "2", "Yaris", "Aqua", "Sienta", "Polo", "CX-3", "Voxy", "Porte", "Yaris Cross",
+			"C-HR", "Vezel"},
+		MaxPrice:   29000,
+		MinYear:    2020,
+		MaxMileage: 50000,
+		MinEngine:  1.5,
+		Gearbox:    GearboxAutomatic,
+		Sellers:    SellerAny,
+	}
+}
+
+// Match reports whether the car meets all criteria of the subscription
+func (s Subscription) Match(c Car) bool {
+	if len(s.Brands) > 0 && !containsFold(s.Brands, c.Manufacturer) || containsFold(s.ExcludeBrands, c.Manufacturer) {
+		return false
+	}
+	if len(s.Models) > 0 && !containsFold(s.Models, c.Model) || containsFold(s.ExcludeModels, c.Model) {
+		return false
+	}
+	if !inRange(c.Price, s.MinPrice, s.MaxPrice) || !inRange(c.Year, s.MinYear, s.MaxYear) ||
+		!inRange(c.Mileage, s.MinMileage, s.MaxMileage) || !inRange(c.EngineSize, s.MinEngine, s.MaxEngine) {
+		return false
+	}
+	if len(s.Fuels) > 0 && !slices.Contains(s.Fuels, c.Fuel) {
+		return false
+	}
+	if len(s.Drives) > 0 && !slices.Contains(s.Drives, c.Drive) {
+		return false
+	}
+	switch s.Gearbox {
+	case GearboxAutomatic:
+		if !c.AutomaticGearbox {
+			return false
+		}
+	case GearboxManual:
+		if c.AutomaticGearbox {
+			return false
+		}
+	}
+	switch s.Sellers {
+	case SellerDealer:
+		if !c.Seller.Dealer {
+			return false
+		}
+	case SellerPrivate:
+		if c.Seller.Dealer {
+			return false
+		}
+	}
+	for _, equipment := range s.Equipment {
+		if !slices.Contains(c.Equipment, equipment) {
+			return false
+		}
+	}
+	if len(s.Districts) > 0 {
+		address := strings.ToLower(c.Address)
+		for _, district := range s.Districts {
+			if strings.Contains(address, strings.ToLower(district)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// MatchingChats returns the chats which have any subscription matching the car
+func MatchingChats(subscriptions []Subscription, c Car) []int64 {
+	var chats []int64
+	for _, s := range subscriptions {
+		if !slices.Contains(chats, s.ChatID) && s.Match(c) {
+			chats = append(chats, s.ChatID)
+		}
+	}
+	return chats
+}
+
+// containsFold reports whether the list contains the value ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// inRange reports whether the value is within the bounds, zero bound is not checked
+func inRange[T int | float64](value, from, to T) bool {
+	return (from == 0 || value >= from) && (to == 0 || value <= to)
+}
+
+// DeliveryMode defines how the notifications are delivered to the user
+type DeliveryMode string
+
+const (
+	// DeliveryInstant sends every notification as a separate message
+	DeliveryInstant DeliveryMode = "instant"
+	// DeliveryRunDigest sends a digest of the notifications after every crawl run
+	DeliveryRunDigest DeliveryMode = "run"
+	// DeliveryDailyDigest sends a digest of the notifications once a day at the digest hour
+	DeliveryDailyDigest DeliveryMode = "daily"
+)
+
 // User model with chatID
 type User struct {
-	ChatID    int64
-	FirstName string
-	LastName  string
-	Username  string
-	Admin     bool
-	Approved  bool
-	UpdatedAt time.Time
-	CreatedAt time.Time
+	ChatID       int64
+	FirstName    string
+	LastName     string
+	Username     string
+	Admin        bool
+	Approved     bool
+	DeliveryMode DeliveryMode
+	// DigestHour is the hour of the day in the app time zone the daily digest is sent at
+	DigestHour int
+	UpdatedAt  time.Time
+	CreatedAt  time.Time
 }
 
 func (u User) String() string {
@@ -66,3 +556,31 @@ func (u User) String() string {
 	result += fmt.Sprintf("%s %s", u.FirstName, u.LastName)
 	return result
 }
+
+// PhotoCount returns the number of the ad photos
+func (c Car) PhotoCount() int {
+	return len(c.Photos)
+}
+
+// MainPhoto returns the URL of the first ad photo or empty string
+func (c Car) MainPhoto() string {
+	if len(c.Photos) == 0 {
+		return ""
+	}
+	return c.Photos[0]
+}
+
+// HasEquipment reports whether the car has the given equipment
+func (c Car) HasEquipment(e Equipment) bool {
+	for _, item := range c.Equipment {
+		if item == e {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRepost reports whether the same vehicle was listed before under another ad
+func (c Car) IsRepost() bool {
+	return c.Previous.AdID != ""
+}
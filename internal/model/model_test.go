@@ -0,0 +1,89 @@
+package model
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionMatch(t *testing.T) {
+	car := Car{
+		Manufacturer:     "Toyota",
+		Model:            "Corolla",
+		Year:             2021,
+		Mileage:          40000,
+		EngineSize:       1.8,
+		Fuel:             FuelTypeHybridPetrol,
+		Drive:            DriveTypeFront,
+		AutomaticGearbox: true,
+		Price:            21000,
+		Address:          "Limassol, Germasogeia",
+		Seller:           Seller{Dealer: true},
+		Equipment:        []Equipment{EquipmentAppleCarPlay, EquipmentRearCamera},
+	}
+	assert.True(t, Subscription{}.Match(car))
+
+	tests := []struct {
+		name         string
+		subscription Subscription
+		match        bool
+	}{
+		{"brand", Subscription{Brands: []string{"toyota", "Lexus"}}, true},
+		{"other brand", Subscription{Brands: []string{"Lexus"}}, false},
+		{"excluded brand", Subscription{ExcludeBrands: []string{"Toyota"}}, false},
+		{"model", Subscription{Models: []string{"Corolla"}}, true},
+		{"excluded model", Subscription{Brands: []string{"Toyota"}, ExcludeModels: []string{"corolla"}}, false},
+		{"price range", Subscription{MinPrice: 15000, MaxPrice: 21000}, true},
+		{"too expensive", Subscription{MaxPrice: 20000}, false},
+		{"too old", Subscription{MinYear: 2022}, false},
+		{"too new", Subscription{MaxYear: 2020}, false},
+		{"mileage", Subscription{MaxMileage: 50000}, true},
+		{"high mileage", Subscription{MaxMileage: 30000}, false},
+		{"engine range", Subscription{MinEngine: 1.5, MaxEngine: 2}, true},
+		{"small engine", Subscription{MinEngine: 2}, false},
+		{"fuel", Subscription{Fuels: []FuelType{FuelTypeHybridPetrol, FuelTypeElectric}}, true},
+		{"other fuel", Subscription{Fuels: []FuelType{FuelTypeDiesel}}, false},
+		{"gearbox", Subscription{Gearbox: GearboxAutomatic}, true},
+		{"manual gearbox", Subscription{Gearbox: GearboxManual}, false},
+		{"drive", Subscription{Drives: []DriveType{DriveTypeAll}}, false},
+		{"district", Subscription{Districts: []string{"Paphos", "germasogeia"}}, true},
+		{"other district", Subscription{Districts: []string{"Nicosia"}}, false},
+		{"dealer", Subscription{Sellers: SellerDealer}, true},
+		{"private seller", Subscription{Sellers: SellerPrivate}, false},
+		{"equipment", Subscription{Equipment: []Equipment{EquipmentRearCamera, EquipmentAppleCarPlay}}, true},
+		{"missing equipment", Subscription{Equipment: []Equipment{EquipmentAppleCarPlay, EquipmentSunroof}}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, tt.subscription.Match(car), tt.name)
+	}
+}
+
+func TestMatchingChats(t *testing.T) {
+	car := Car{Manufacturer: "BMW", Model: "X5", Price: 30000}
+	subscriptions := []Subscription{
+		{ChatID: 1, Brands: []string{"BMW"}},
+		{ChatID: 1, MaxPrice: 40000},
+		{ChatID: 2, MaxPrice: 20000},
+		{ChatID: 3, Models: []string{"X5"}},
+	}
+	assert.Equal(t, []int64{1, 3}, MatchingChats(subscriptions, car))
+}
+
+func TestOutboxKey(t *testing.T) {
+	assert.Equal(t, "new:42:123", OutboxKey(DeliveryNewAd, 42, "123"))
+	assert.Equal(t, "price:42:123:9500:2024-05-01", OutboxKey(DeliveryPriceChanged, 42, "123", 9500, "2024-05-01"))
+}
+
+func TestCrawlRunRate(t *testing.T) {
+	started := time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC)
+	run := CrawlRun{StartedAt: started, FinishedAt: started.Add(100 * time.Second), Brands: []CrawlBrand{
+		{Brand: "Audi", CrawlStats: CrawlStats{Requests: 120, Duration: 60 * time.Second}},
+		{Brand: "BMW", CrawlStats: CrawlStats{Requests: 80, Duration: 80 * time.Second}},
+		{Brand: "Mini"},
+	}}
+	assert.Equal(t, 2.0, run.Brands[0].Rate())
+	assert.Equal(t, 1.0, run.Brands[1].Rate())
+	assert.Zero(t, run.Brands[2].Rate())
+	// the brands are crawled concurrently
+	assert.Equal(t, 2.0, run.Rate())
+}
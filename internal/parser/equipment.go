@@ -0,0 +1,109 @@
+package parser
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"log/slog"
+	"strings"
+)
+
+// equipmentVariants maps free-text variants of the "Extras" characteristic to the equipment vocabulary.
+// Keys are normalized with normalizeEquipment.
+var equipmentVariants = map[string]model.Equipment{
+	"alloy wheels":              model.EquipmentAlloyWheels,
+	"alloys":                    model.EquipmentAlloyWheels,
+	"cruise control":            model.EquipmentCruiseControl,
+	"adaptive cruise control":   model.EquipmentAdaptiveCruise,
+	"adaptive cruise":           model.EquipmentAdaptiveCruise,
+	"rear view camera":          model.EquipmentRearCamera,
+	"rear camera":               model.EquipmentRearCamera,
+	"reverse camera":            model.EquipmentRearCamera,
+	"reversing camera":          model.EquipmentRearCamera,
+	"360 camera":                model.EquipmentCamera360,
+	"360 view camera":           model.EquipmentCamera360,
+	"start stop":                model.EquipmentStartStop,
+	"sunroof":                   model.EquipmentSunroof,
+	"sun roof":                  model.EquipmentSunroof,
+	"panoramic roof":            model.EquipmentPanoramicRoof,
+	"panoramic sunroof":         model.EquipmentPanoramicRoof,
+	"panorama roof":             model.EquipmentPanoramicRoof,
+	"android auto":              model.EquipmentAndroidAuto,
+	"apple car play":            model.EquipmentAppleCarPlay,
+	"apple carplay":             model.EquipmentAppleCarPlay,
+	"carplay":                   model.EquipmentAppleCarPlay,
+	"folding mirrors":           model.EquipmentFoldingMirrors,
+	"electric folding mirrors":  model.EquipmentFoldingMirrors,
+	"leather seats":             model.EquipmentLeatherSeats,
+	"leather interior":          model.EquipmentLeatherSeats,
+	"leather":                   model.EquipmentLeatherSeats,
+	"heated seats":              model.EquipmentHeatedSeats,
+	"electric seats":            model.EquipmentElectricSeats,
+	"power seats":               model.EquipmentElectricSeats,
+	"parking sensors":           model.EquipmentParkingSensors,
+	"park sensors":              model.EquipmentParkingSensors,
+	"parktronic":                model.EquipmentParkingSensors,
+	"lane assist":               model.EquipmentLaneAssist,
+	"lane keeping assist":       model.EquipmentLaneAssist,
+	"lane departure warning":    model.EquipmentLaneAssist,
+	"blind spot monitor":        model.EquipmentBlindSpotMonitor,
+	"blind spot assist":         model.EquipmentBlindSpotMonitor,
+	"navigation":                model.EquipmentNavigation,
+	"navigation system":         model.EquipmentNavigation,
+	"gps":                       model.EquipmentNavigation,
+	"sat nav":                   model.EquipmentNavigation,
+	"bluetooth":                 model.EquipmentBluetooth,
+	"keyless entry":             model.EquipmentKeyless,
+	"keyless go":                model.EquipmentKeyless,
+	"keyless":                   model.EquipmentKeyless,
+	"climate control":           model.EquipmentClimateControl,
+	"dual zone climate control": model.EquipmentClimateControl,
+	"led headlights":            model.EquipmentLEDHeadlights,
+	"led lights":                model.EquipmentLEDHeadlights,
+	"xenon headlights":          model.EquipmentXenonHeadlights,
+	"xenon":                     model.EquipmentXenonHeadlights,
+	"head up display":           model.EquipmentHeadUpDisplay,
+	"hud":                       model.EquipmentHeadUpDisplay,
+	"tow bar":                   model.EquipmentTowBar,
+	"towbar":                    model.EquipmentTowBar,
+	"electric tailgate":         model.EquipmentElectricTailgate,
+	"power tailgate":            model.EquipmentElectricTailgate,
+	"wireless charging":         model.EquipmentWirelessCharging,
+	"premium sound system":      model.EquipmentPremiumSound,
+	"premium audio":             model.EquipmentPremiumSound,
+}
+
+// normalizeEquipment lowercases the text and replaces punctuation with spaces
+func normalizeEquipment(text string) string {
+	text = strings.ToLower(text)
+	text = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '-', '_', '.', '(', ')':
+			return ' '
+		}
+		return r
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// parseEquipment splits the "Extras" text and maps each item to the equipment vocabulary.
+// Unknown items are skipped.
+func parseEquipment(extras string) []model.Equipment {
+	var result []model.Equipment
+	seen := make(map[model.Equipment]bool)
+	for _, item := range strings.Split(extras, ",") {
+		item = normalizeEquipment(item)
+		if item == "" {
+			continue
+		}
+		equipment, ok := equipmentVariants[item]
+		if !ok {
+			slog.Debug("Unknown equipment", "extra", item)
+			continue
+		}
+		if seen[equipment] {
+			continue
+		}
+		seen[equipment] = true
+		result = append(result, equipment)
+	}
+	return result
+}
@@ -1,6 +1,37 @@
 package parser
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 var ErrStatusNotFound = fmt.Errorf("not found")
 var ErrStatusForbidden = fmt.Errorf("forbidden")
+var ErrTooManyRequests = fmt.Errorf("too many requests")
+var ErrServerError = fmt.Errorf("server error")
+var ErrUnexpectedStatus = fmt.Errorf("unexpected status")
+var ErrRetriesExhausted = fmt.Errorf("retries exhausted")
+var ErrNoProxyAvailable = fmt.Errorf("no proxy available")
+var ErrTooLarge = fmt.Errorf("response is too large")
+
+// StatusError is returned when the server responds with non 200 status code.
+// It wraps one of ErrStatusNotFound, ErrStatusForbidden, ErrTooManyRequests, ErrServerError or ErrUnexpectedStatus.
+type StatusError struct {
+	URL        string
+	Code       int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: status code %d: %s", e.URL, e.Code, e.Err)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *StatusError) Temporary() bool {
+	return e.Err != ErrStatusNotFound && e.Err != ErrUnexpectedStatus
+}
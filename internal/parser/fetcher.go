@@ -0,0 +1,204 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/config"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Fetcher fetches the page body by URL
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// HTTPFetcher is the default Fetcher with request timeout, per host rate limit, optional proxy pool
+// and bounded retries with exponential backoff
+type HTTPFetcher struct {
+	client      *http.Client
+	limiter     *AdaptiveLimiter
+	proxies     *ProxyPool
+	maxRetries  int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+}
+
+// NewHTTPFetcher returns a new HTTPFetcher
+func NewHTTPFetcher(conf config.Parser) (*HTTPFetcher, error) {
+	proxies, err := NewProxyPool(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPFetcher{
+		client:      &http.Client{Timeout: conf.Timeout},
+		limiter:     NewAdaptiveLimiter(conf),
+		proxies:     proxies,
+		maxRetries:  conf.MaxRetries,
+		backoffBase: conf.BackoffBase,
+		backoffMax:  conf.BackoffMax,
+	}, nil
+}
+
+// Fetch returns the body of the page. Temporary failures are retried up to maxRetries times,
+// after that the last error is returned wrapped with ErrRetriesExhausted.
+func (f *HTTPFetcher) Fetch(ctx context.Context, pageURL string) (io.ReadCloser, error) {
+	var lastErr error
+	for attempt := 0; attempt <= f.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, f.delay(attempt, lastErr)); err != nil {
+				return nil, err
+			}
+		}
+		body, err := f.fetch(ctx, pageURL)
+		if err == nil {
+			return body, nil
+		}
+		if !isTemporary(ctx, err) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("%w: %w", ErrRetriesExhausted, lastErr)
+}
+
+func (f *HTTPFetcher) fetch(ctx context.Context, pageURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgents[rand.Intn(len(userAgents))])
+
+	client := f.client
+	var pr *proxy
+	if f.proxies != nil {
+		if pr, err = f.proxies.pick(req.URL.Host); err != nil {
+			return nil, err
+		}
+		client = pr.client
+	} else {
+		req.Header.Set("X-Forwarded-For", forwardIP())
+	}
+
+	if err = f.limiter.Wait(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if pr != nil {
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		f.proxies.report(pr, statusCode, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	countResponse(ctx, resp.StatusCode)
+	f.limiter.Report(req.URL.Host,
+		resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{
+			URL:        pageURL,
+			Code:       resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Err:        statusErr(resp.StatusCode),
+		}
+	}
+	return resp.Body, nil
+}
+
+// Rate returns the effective request rate to the host of the URL
+func (f *HTTPFetcher) Rate(rawURL string) float64 {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0
+	}
+	return f.limiter.Rate(u.Host)
+}
+
+// ProxyStats returns the statistics of the proxies or nil if proxies are not used
+func (f *HTTPFetcher) ProxyStats() []ProxyStats {
+	if f.proxies == nil {
+		return nil
+	}
+	return f.proxies.Stats()
+}
+
+// delay returns the time to wait before the attempt: Retry-After if the server sent it,
+// exponential backoff with jitter otherwise. The delay never exceeds backoffMax.
+func (f *HTTPFetcher) delay(attempt int, lastErr error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(lastErr, &statusErr) && statusErr.RetryAfter > 0 {
+		return min(statusErr.RetryAfter, f.backoffMax)
+	}
+	backoff := f.backoffMax
+	if shift := attempt - 1; shift < 31 {
+		backoff = min(f.backoffBase<<shift, f.backoffMax)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	// half of the backoff is a random jitter
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// isTemporary reports whether the request failed with error worth retrying
+func isTemporary(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	// network errors and timeouts
+	return true
+}
+
+func statusErr(code int) error {
+	switch {
+	case code == http.StatusNotFound || code == http.StatusGone:
+		return ErrStatusNotFound
+	case code == http.StatusForbidden:
+		return ErrStatusForbidden
+	case code == http.StatusTooManyRequests:
+		return ErrTooManyRequests
+	case code >= http.StatusInternalServerError:
+		return ErrServerError
+	default:
+		return ErrUnexpectedStatus
+	}
+}
+
+// parseRetryAfter parses Retry-After header value in seconds or HTTP date format
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// sleep waits for the duration or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,160 @@
+package parser
+
+import (
+	"context"
+	"github.com/bopoh24/bazacars/internal/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testFetcherConfig() config.Parser {
+	return config.Parser{
+		Timeout:     time.Second,
+		MaxRetries:  3,
+		BackoffBase: time.Millisecond,
+		BackoffMax:  10 * time.Millisecond,
+		Rate:        1000,
+		MinRate:     100,
+		MaxRate:     1000,
+		Burst:       10,
+	}
+}
+
+func newTestFetcher(t *testing.T, conf config.Parser) *HTTPFetcher {
+	fetcher, err := NewHTTPFetcher(conf)
+	assert.NoError(t, err)
+	return fetcher
+}
+
+func TestHTTPFetcherRetriesTemporaryErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	body, err := newTestFetcher(t, testFetcherConfig()).Fetch(context.Background(), server.URL)
+	assert.NoError(t, err)
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(data))
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestHTTPFetcherBoundedRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := newTestFetcher(t, testFetcherConfig()).Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, ErrRetriesExhausted)
+	assert.ErrorIs(t, err, ErrStatusForbidden)
+	assert.Equal(t, int32(4), requests.Load())
+}
+
+func TestHTTPFetcherCountsForbiddenResponses(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	stats := &FetchStats{}
+	ctx := WithFetchStats(context.Background(), stats)
+	body, err := newTestFetcher(t, testFetcherConfig()).Fetch(ctx, server.URL)
+	assert.NoError(t, err)
+	body.Close()
+	assert.Equal(t, int64(3), stats.Requests.Load())
+	assert.Equal(t, int64(2), stats.Forbidden.Load())
+}
+
+func TestHTTPFetcherNotFoundIsNotRetried(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := newTestFetcher(t, testFetcherConfig()).Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, ErrStatusNotFound)
+	assert.NotErrorIs(t, err, ErrRetriesExhausted)
+	var statusErr *StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusNotFound, statusErr.Code)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestHTTPFetcherRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	conf := testFetcherConfig()
+	conf.BackoffMax = 5 * time.Second
+	started := time.Now()
+	body, err := newTestFetcher(t, conf).Fetch(context.Background(), server.URL)
+	assert.NoError(t, err)
+	body.Close()
+	assert.GreaterOrEqual(t, time.Since(started), time.Second)
+}
+
+func TestHTTPFetcherTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	conf := testFetcherConfig()
+	conf.Timeout = 20 * time.Millisecond
+	conf.MaxRetries = 1
+	_, err := newTestFetcher(t, conf).Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, ErrRetriesExhausted)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, time.Minute, parseRetryAfter(date), float64(2*time.Second))
+}
+
+func TestParserFetchPhotoSizeCap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, 100))
+	}))
+	defer server.Close()
+
+	p := New(newTestFetcher(t, testFetcherConfig()))
+	data, err := p.FetchPhoto(context.Background(), server.URL, 100)
+	assert.NoError(t, err)
+	assert.Len(t, data, 100)
+
+	_, err = p.FetchPhoto(context.Background(), server.URL, 99)
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"context"
+	"github.com/bopoh24/bazacars/internal/config"
+	"github.com/bopoh24/bazacars/pkg/ratelimit"
+	"sync"
+	"time"
+)
+
+const (
+	// blockedWindow is the period in which blocked responses are counted
+	blockedWindow = time.Minute
+	// blockedThreshold is the number of blocked responses in blockedWindow which lowers the rate
+	blockedThreshold = 3
+	// successesToIncrease is the number of successful responses in a row which raises the rate
+	successesToIncrease = 50
+
+	rateDecreaseFactor = 0.5
+	rateIncreaseFactor = 1.2
+)
+
+// AdaptiveLimiter is a per host rate limiter. It lowers the request rate when the host
+// responds with 403 or 429 frequently and raises it back once blocking stops.
+type AdaptiveLimiter struct {
+	mu      sync.Mutex
+	hosts   map[string]*hostLimiter
+	rate    float64
+	minRate float64
+	maxRate float64
+	burst   int
+}
+
+type hostLimiter struct {
+	bucket    *ratelimit.TokenBucket
+	blocked   []time.Time
+	successes int
+}
+
+// NewAdaptiveLimiter returns a new AdaptiveLimiter
+func NewAdaptiveLimiter(conf config.Parser) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		hosts:   make(map[string]*hostLimiter),
+		rate:    conf.Rate,
+		minRate: conf.MinRate,
+		maxRate: conf.MaxRate,
+		burst:   conf.Burst,
+	}
+}
+
+// Wait blocks until the request to the host is allowed
+func (l *AdaptiveLimiter) Wait(ctx context.Context, host string) error {
+	return l.host(host).bucket.Wait(ctx)
+}
+
+// Report adjusts the rate of the host according to the response status
+func (l *AdaptiveLimiter) Report(host string, blocked bool) {
+	h := l.host(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if blocked {
+		h.successes = 0
+		h.blocked = append(h.blocked, now)
+		// forget blocked responses out of the window
+		for len(h.blocked) > 0 && now.Sub(h.blocked[0]) > blockedWindow {
+			h.blocked = h.blocked[1:]
+		}
+		if len(h.blocked) >= blockedThreshold {
+			h.blocked = h.blocked[:0]
+			h.bucket.SetRate(max(h.bucket.Rate()*rateDecreaseFactor, l.minRate))
+		}
+		return
+	}
+	h.successes++
+	if h.successes >= successesToIncrease {
+		h.successes = 0
+		h.bucket.SetRate(min(h.bucket.Rate()*rateIncreaseFactor, l.maxRate))
+	}
+}
+
+// Rate returns the effective request rate to the host
+func (l *AdaptiveLimiter) Rate(host string) float64 {
+	return l.host(host).bucket.Rate()
+}
+
+func (l *AdaptiveLimiter) host(host string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimiter{bucket: ratelimit.NewTokenBucket(l.rate, l.burst)}
+		l.hosts[host] = h
+	}
+	return h
+}
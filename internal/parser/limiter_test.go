@@ -0,0 +1,35 @@
+package parser
+
+import (
+	"github.com/bopoh24/bazacars/internal/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	limiter := NewAdaptiveLimiter(config.Parser{Rate: 4, MinRate: 1, MaxRate: 5, Burst: 1})
+	assert.Equal(t, 4.0, limiter.Rate("example.com"))
+
+	// a single forbidden response does not change the rate
+	limiter.Report("example.com", true)
+	assert.Equal(t, 4.0, limiter.Rate("example.com"))
+
+	// frequent ones do
+	for i := 0; i < blockedThreshold; i++ {
+		limiter.Report("example.com", true)
+	}
+	assert.Equal(t, 2.0, limiter.Rate("example.com"))
+	for i := 0; i < blockedThreshold*2; i++ {
+		limiter.Report("example.com", true)
+	}
+	assert.Equal(t, 1.0, limiter.Rate("example.com"))
+
+	// other hosts are not affected
+	assert.Equal(t, 4.0, limiter.Rate("other.com"))
+
+	// the rate is raised back when blocking stops
+	for i := 0; i < successesToIncrease*10; i++ {
+		limiter.Report("example.com", false)
+	}
+	assert.Equal(t, 5.0, limiter.Rate("example.com"))
+}
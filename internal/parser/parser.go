@@ -1,13 +1,13 @@
 package parser
 
 import (
+	"context"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/bopoh24/bazacars/internal/model"
 	"io"
 	"log/slog"
 	"math/rand"
-	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -28,9 +28,45 @@ func forwardIP() string {
 	return fmt.Sprintf("31.216.%d.%d", 64+rand.Intn(255-64), 1+rand.Intn(253))
 }
 
+// RateReporter is implemented by fetchers which limit the request rate
+type RateReporter interface {
+	Rate(url string) float64
+}
+
+// ProxyStatsReporter is implemented by fetchers which use outbound proxies
+type ProxyStatsReporter interface {
+	ProxyStats() []ProxyStats
+}
+
+// Parser fetches the pages of the target site and extracts data from them
+type Parser struct {
+	fetcher Fetcher
+}
+
+// New returns a new Parser
+func New(fetcher Fetcher) *Parser {
+	return &Parser{fetcher: fetcher}
+}
+
+// Rate returns the effective request rate to the host of the URL or 0 if the rate is not limited
+func (p *Parser) Rate(url string) float64 {
+	if reporter, ok := p.fetcher.(RateReporter); ok {
+		return reporter.Rate(url)
+	}
+	return 0
+}
+
+// ProxyStats returns the statistics of the fetcher proxies or nil if proxies are not used
+func (p *Parser) ProxyStats() []ProxyStats {
+	if reporter, ok := p.fetcher.(ProxyStatsReporter); ok {
+		return reporter.ProxyStats()
+	}
+	return nil
+}
+
 // ParseCarBrands parses the page and returns the list of car manufacturers
-func ParseCarBrands(url string) (map[string]string, error) {
-	body, err := urlBody(url)
+func (p *Parser) ParseCarBrands(ctx context.Context, url string) (map[string]string, error) {
+	body, err := p.fetcher.Fetch(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -39,8 +75,8 @@ func ParseCarBrands(url string) (map[string]string, error) {
 }
 
 // ParseAdList parses the page and returns the list of ads
-func ParseAdList(url string) ([]string, error) {
-	body, err := urlBody(url)
+func (p *Parser) ParseAdList(ctx context.Context, url string) ([]model.AdSummary, error) {
+	body, err := p.fetcher.Fetch(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -49,8 +85,8 @@ func ParseAdList(url string) ([]string, error) {
 }
 
 // ParseCarPage parses the page and returns the car data
-func ParseCarPage(url string) (model.Car, error) {
-	body, err := urlBody(url)
+func (p *Parser) ParseCarPage(ctx context.Context, url string) (model.Car, error) {
+	body, err := p.fetcher.Fetch(ctx, url)
 	if err != nil {
 		return model.Car{}, err
 	}
@@ -64,8 +100,8 @@ func ParseCarPage(url string) (model.Car, error) {
 }
 
 // TotalPages returns the total number of pages
-func TotalPages(url string) (int, error) {
-	body, err := urlBody(url)
+func (p *Parser) TotalPages(ctx context.Context, url string) (int, error) {
+	body, err := p.fetcher.Fetch(ctx, url)
 	if err != nil {
 		return 0, err
 	}
@@ -73,6 +109,23 @@ func TotalPages(url string) (int, error) {
 	return extractTotalPages(body)
 }
 
+// FetchPhoto downloads the photo. The photos larger than maxBytes are rejected with ErrTooLarge.
+func (p *Parser) FetchPhoto(ctx context.Context, url string, maxBytes int64) ([]byte, error) {
+	body, err := p.fetcher.Fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%s: %w", url, ErrTooLarge)
+	}
+	return data, nil
+}
+
 func extractTotalPages(body io.ReadCloser) (int, error) {
 	doc, err := goquery.NewDocumentFromReader(body)
 	if err != nil {
@@ -85,31 +138,6 @@ func extractTotalPages(body io.ReadCloser) (int, error) {
 	return strconv.Atoi(pages)
 }
 
-func urlBody(url string) (io.ReadCloser, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", userAgents[rand.Intn(len(userAgents))])
-	req.Header.Set("X-Forwarded-For", forwardIP())
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		if resp.StatusCode == http.StatusNotFound {
-			return nil, ErrStatusNotFound
-		}
-		if resp.StatusCode == http.StatusForbidden {
-			return nil, ErrStatusForbidden
-		}
-		return nil, fmt.Errorf("status code error: %d %s", resp.StatusCode, resp.Status)
-	}
-	return resp.Body, nil
-}
-
 func extractCarData(body io.ReadCloser) (model.Car, error) {
 	var carData model.Car
 	// Load the HTML document
@@ -187,9 +215,48 @@ func extractCarData(body io.ReadCloser) (model.Car, error) {
 			if err != nil {
 				slog.Error("Error parsing engine size", "engine_size", engineSizeTxt, "err", err)
 			}
+
+		// doors
+		case "Doors:":
+			carData.Doors = parseDoors(s.Next().Text())
+
+		// seats
+		case "Seats:":
+			seatsTxt := strings.TrimSpace(s.Next().Text())
+			carData.Seats, err = strconv.Atoi(seatsTxt)
+			if err != nil {
+				slog.Error("Error parsing seats", "seats", seatsTxt, "err", err)
+			}
+
+		// body type
+		case "Body type:":
+			carData.BodyType = model.BodyType(strings.TrimSpace(s.Next().Text()))
+
+		// condition
+		case "Condition:":
+			carData.Condition = model.Condition(strings.TrimSpace(s.Next().Text()))
+
+		// MOT
+		case "MOT till:":
+			motTxt := strings.TrimSpace(s.Next().Text())
+			carData.MOTTill, err = time.Parse("01/2006", motTxt)
+			if err != nil {
+				slog.Error("Error parsing MOT", "mot", motTxt, "err", err)
+			}
+
+		// extras
+		case "Extras:":
+			carData.Equipment = parseEquipment(s.Next().Text())
+
+		// availability
+		case "Availability:":
+			carData.Availability = strings.TrimSpace(s.Next().Text())
 		}
 
 	})
+	carData.Photos = extractPhotos(doc)
+	carData.Seller = extractSeller(doc)
+
 	descriptionText := doc.Find(".js-description").Text()
 	descriptionText = strings.Replace(descriptionText, "<p>", "", -1)
 	descriptionText = strings.Replace(descriptionText, "</p>", "\n", -1)
@@ -212,6 +279,39 @@ func extractCarData(body io.ReadCloser) (model.Car, error) {
 	return carData, nil
 }
 
+// extractPhotos returns full-size photo URLs in the order they are shown on the page
+func extractPhotos(doc *goquery.Document) []string {
+	var photos []string
+	doc.Find(".announcement__images-item").Each(func(i int, s *goquery.Selection) {
+		link, ok := s.Attr("data-full")
+		if !ok || link == "" {
+			link, ok = s.Attr("src")
+		}
+		if ok && link != "" {
+			photos = append(photos, link)
+		}
+	})
+	return photos
+}
+
+// extractSeller returns the seller from the ad page
+func extractSeller(doc *goquery.Document) model.Seller {
+	author := doc.Find(".author-info").First()
+	authorName := author.Find(".author-name")
+	seller := model.Seller{
+		Name:     strings.TrimSpace(authorName.Text()),
+		Verified: author.HasClass("_verified"),
+		// business accounts have a logo and a business contact popup
+		Dealer: authorName.Find("a img").Length() > 0 ||
+			doc.Find(".js-show-popup-contact-business").Length() > 0,
+	}
+	seller.Link, _ = authorName.Find("a").Attr("href")
+	if seller.Link == "" {
+		seller.Link, _ = author.Find(".other-announcement-author").Attr("href")
+	}
+	return seller
+}
+
 func parseDriveType(drive string) model.DriveType {
 	if strings.Contains(drive, string(model.DriveTypeAll)) {
 		return model.DriveTypeAll
@@ -222,6 +322,18 @@ func parseDriveType(drive string) model.DriveType {
 	return model.DriveTypeFront
 }
 
+// parseDoors returns the biggest number of doors from the text like "4 doors - 5 doors"
+func parseDoors(doors string) int {
+	result := 0
+	for _, field := range strings.Fields(doors) {
+		n, err := strconv.Atoi(field)
+		if err == nil && n > result {
+			result = n
+		}
+	}
+	return result
+}
+
 func extractCarManufacturers(body io.ReadCloser) (map[string]string, error) {
 	result := make(map[string]string)
 	// Load the HTML document
@@ -238,8 +350,8 @@ func extractCarManufacturers(body io.ReadCloser) (map[string]string, error) {
 	return result, nil
 }
 
-func extractAdList(body io.ReadCloser) ([]string, error) {
-	var result []string
+func extractAdList(body io.ReadCloser) ([]model.AdSummary, error) {
+	var result []model.AdSummary
 	// Load the HTML document
 	doc, err := goquery.NewDocumentFromReader(body)
 	if err != nil {
@@ -254,7 +366,66 @@ func extractAdList(body io.ReadCloser) ([]string, error) {
 		}
 		// Remove query parameters
 		parsedURL.RawQuery = ""
-		result = append(result, parsedURL.String())
+		card := s.Parent()
+		summary := model.AdSummary{
+			Link:   parsedURL.String(),
+			Title:  strings.TrimSpace(card.Find(".advert__content-title").Text()),
+			Price:  extractCardPrice(card),
+			Seller: extractCardSeller(card),
+		}
+		summary.AdID, _ = card.Attr("data-id")
+		dateTxt := strings.TrimSpace(card.Find(".advert__content-date").Text())
+		summary.Posted, err = parseListDate(dateTxt, time.Now())
+		if err != nil {
+			slog.Debug("Error parsing list date", "date", dateTxt, "err", err)
+		}
+		result = append(result, summary)
 	})
 	return result, nil
 }
+
+// extractCardPrice returns the current price from the list card, the old discounted price is ignored
+func extractCardPrice(card *goquery.Selection) int {
+	price := card.Find(".advert__content-price span").First().Clone()
+	price.Find(".advert__content-price--discount").Remove()
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, price.Text())
+	result, _ := strconv.Atoi(digits)
+	return result
+}
+
+// parseListDate converts the list card date like "Today", "Yesterday", "3 days ago" or "24.02.2024" to a date
+func parseListDate(text string, now time.Time) (time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch text {
+	case "Today":
+		return today, nil
+	case "Yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+	if daysTxt, ok := strings.CutSuffix(text, " days ago"); ok {
+		days, err := strconv.Atoi(daysTxt)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return today.AddDate(0, 0, -days), nil
+	}
+	return time.Parse("02.01.2006", text)
+}
+
+// extractCardSeller returns the seller from the list card
+func extractCardSeller(card *goquery.Selection) model.Seller {
+	header := card.Find(".advert__header")
+	logo := header.Find(".advert__header-logo")
+	seller := model.Seller{
+		Name:     strings.TrimSpace(header.Find(".advert__header-name").Text()),
+		Verified: header.Find(".advert__header-verified").Length() > 0,
+		Dealer:   logo.Length() > 0,
+	}
+	seller.Link, _ = logo.Attr("href")
+	return seller
+}
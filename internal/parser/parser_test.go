@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestExtractCarData(t *testing.T) {
@@ -29,6 +30,33 @@ func TestExtractCarData(t *testing.T) {
 	assert.Equal(t, "BMW", carData.Manufacturer)
 	assert.Equal(t, "3-Series", carData.Model)
 	assert.Equal(t, 25900, carData.Price)
+	assert.Equal(t, 5, carData.Doors)
+	assert.Equal(t, 5, carData.Seats)
+	assert.Equal(t, model.BodyTypeSaloon, carData.BodyType)
+	assert.Equal(t, model.ConditionUsed, carData.Condition)
+	assert.Equal(t, "12.2024", carData.MOTTill.Format("01.2006"))
+	assert.Equal(t, "In stock", carData.Availability)
+	assert.Contains(t, carData.Equipment, model.EquipmentAppleCarPlay)
+	assert.Contains(t, carData.Equipment, model.EquipmentParkingSensors)
+	assert.Contains(t, carData.Equipment, model.EquipmentLeatherSeats)
+	assert.Len(t, carData.Equipment, 11)
+	assert.Equal(t, 13, carData.PhotoCount())
+	assert.Equal(t, "https://cdn1.some-site.com/media/cache1/61/4a/614aa573921148fc5f8e06171c5cb44c.jpg",
+		carData.MainPhoto())
+	assert.Equal(t, "https://cdn1.some-site.com/media/cache1/ee/ee/eeee222ea8ff31a3b4610d8847331f58.jpg",
+		carData.Photos[12])
+	assert.Equal(t, model.Seller{
+		Name:     "MS AUTOTRADE LTD",
+		Verified: true,
+		Dealer:   true,
+		Link:     "/MSAUTOTRADE/",
+	}, carData.Seller)
+}
+
+func TestParseEquipment(t *testing.T) {
+	result := parseEquipment("Apple CarPlay, apple car-play, Panoramic Sunroof, Leather, Unknown gadget, ")
+	assert.Equal(t, []model.Equipment{model.EquipmentAppleCarPlay, model.EquipmentPanoramicRoof,
+		model.EquipmentLeatherSeats}, result)
 }
 
 func TestExtractCarManufactures(t *testing.T) {
@@ -51,7 +79,40 @@ func TestExtractAdList(t *testing.T) {
 	result, err := extractAdList(f)
 	assert.NoError(t, err)
 	assert.Equal(t, 60, len(result))
-	assert.Equal(t, "/adv/4949445_suzuki-sx4-1-6l-2019/", result[0])
+	assert.Equal(t, "/adv/4949445_suzuki-sx4-1-6l-2019/", result[0].Link)
+	assert.Equal(t, model.Seller{
+		Name:     "ANDYS MOTORS LTD",
+		Verified: true,
+		Dealer:   true,
+		Link:     "/andysmotors/",
+	}, result[0].Seller)
+	assert.Equal(t, "/adv/5140974_mazda-2-1-5l-2021/", result[1].Link)
+	assert.False(t, result[1].Seller.Dealer)
+
+	assert.Equal(t, "4949445", result[0].AdID)
+	assert.Equal(t, "Suzuki SX4 1,6L 2019", result[0].Title)
+	assert.Equal(t, 16950, result[0].Price)
+	assert.Equal(t, time.Now().Format("2006-01-02"), result[0].Posted.Format("2006-01-02"))
+	// discounted price
+	assert.Equal(t, "5017531", result[2].AdID)
+	assert.Equal(t, 22400, result[2].Price)
+}
+
+func TestParseListDate(t *testing.T) {
+	now := time.Date(2024, 3, 2, 15, 4, 5, 0, time.UTC)
+	tests := map[string]string{
+		"Today":      "2024-03-02",
+		"Yesterday":  "2024-03-01",
+		"3 days ago": "2024-02-28",
+		"24.02.2024": "2024-02-24",
+	}
+	for text, expected := range tests {
+		date, err := parseListDate(text, now)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, date.Format("2006-01-02"), text)
+	}
+	_, err := parseListDate("a while ago", now)
+	assert.Error(t, err)
 }
 
 func TestExtractTotalPages(t *testing.T) {
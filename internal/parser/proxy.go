@@ -0,0 +1,144 @@
+package parser
+
+import (
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/config"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	ProxySelectionRoundRobin = "round-robin"
+	ProxySelectionSticky     = "sticky"
+)
+
+// ProxyStats is the usage statistics of a proxy
+type ProxyStats struct {
+	Proxy        string
+	Requests     int64
+	Successes    int64
+	Failures     int64
+	Blocked      int64
+	Benched      int64
+	BenchedUntil time.Time
+}
+
+// ProxyPool selects outbound proxies and benches the ones blocked by the target site
+type ProxyPool struct {
+	mu         sync.Mutex
+	proxies    []*proxy
+	next       int
+	sticky     bool
+	hosts      map[string]*proxy
+	maxBlocked int
+	benchTime  time.Duration
+}
+
+type proxy struct {
+	client  *http.Client
+	blocked int
+	stats   ProxyStats
+}
+
+// NewProxyPool returns a new ProxyPool or nil if there are no proxies in config
+func NewProxyPool(conf config.Parser) (*ProxyPool, error) {
+	if len(conf.Proxies) == 0 {
+		return nil, nil
+	}
+	pool := &ProxyPool{
+		hosts:      make(map[string]*proxy),
+		maxBlocked: conf.ProxyMaxBlocked,
+		benchTime:  conf.ProxyBenchTime,
+	}
+	switch conf.ProxySelection {
+	case ProxySelectionRoundRobin, "":
+	case ProxySelectionSticky:
+		pool.sticky = true
+	default:
+		return nil, fmt.Errorf("unknown proxy selection %q", conf.ProxySelection)
+	}
+	for _, rawURL := range conf.Proxies {
+		proxyURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", rawURL, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+		pool.proxies = append(pool.proxies, &proxy{
+			client: &http.Client{
+				Timeout:   conf.Timeout,
+				Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+			},
+			// don't expose credentials in stats
+			stats: ProxyStats{Proxy: proxyURL.Redacted()},
+		})
+	}
+	return pool, nil
+}
+
+// pick returns a proxy for the request to the host
+func (p *ProxyPool) pick(host string) (*proxy, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.sticky {
+		if pr, ok := p.hosts[host]; ok && !pr.benched(now) {
+			pr.stats.Requests++
+			return pr, nil
+		}
+	}
+	for range p.proxies {
+		pr := p.proxies[p.next]
+		p.next = (p.next + 1) % len(p.proxies)
+		if pr.benched(now) {
+			continue
+		}
+		if p.sticky {
+			p.hosts[host] = pr
+		}
+		pr.stats.Requests++
+		return pr, nil
+	}
+	return nil, ErrNoProxyAvailable
+}
+
+// report updates the proxy health with the result of the request
+func (p *ProxyPool) report(pr *proxy, statusCode int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case err != nil:
+		pr.stats.Failures++
+	case statusCode == http.StatusForbidden || statusCode == http.StatusTooManyRequests:
+		pr.stats.Blocked++
+		pr.blocked++
+		if pr.blocked >= p.maxBlocked {
+			pr.blocked = 0
+			pr.stats.Benched++
+			pr.stats.BenchedUntil = time.Now().Add(p.benchTime)
+		}
+	default:
+		pr.blocked = 0
+		pr.stats.Successes++
+	}
+}
+
+// Stats returns the statistics of all proxies
+func (p *ProxyPool) Stats() []ProxyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]ProxyStats, 0, len(p.proxies))
+	for _, pr := range p.proxies {
+		result = append(result, pr.stats)
+	}
+	return result
+}
+
+func (pr *proxy) benched(now time.Time) bool {
+	return now.Before(pr.stats.BenchedUntil)
+}
@@ -0,0 +1,33 @@
+package parser
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// FetchStats counts the responses to the requests made with the context returned by WithFetchStats.
+// Every attempt is counted, including the retried ones.
+type FetchStats struct {
+	Requests  atomic.Int64
+	Forbidden atomic.Int64
+}
+
+type fetchStatsKey struct{}
+
+// WithFetchStats returns a copy of the context which collects fetch statistics into stats
+func WithFetchStats(ctx context.Context, stats *FetchStats) context.Context {
+	return context.WithValue(ctx, fetchStatsKey{}, stats)
+}
+
+// countResponse adds the response status to the statistics of the context if there are any
+func countResponse(ctx context.Context, statusCode int) {
+	stats, ok := ctx.Value(fetchStatsKey{}).(*FetchStats)
+	if !ok || stats == nil {
+		return
+	}
+	stats.Requests.Add(1)
+	if statusCode == http.StatusForbidden {
+		stats.Forbidden.Add(1)
+	}
+}
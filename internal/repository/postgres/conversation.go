@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"time"
+)
+
+// Conversation returns the conversation of the user including the expired one
+func (r *Repository) Conversation(ctx context.Context, chatID int64) (model.Conversation, error) {
+	var c model.Conversation
+	err := r.psql.Builder().Select("chat_id", "flow", "step", "data", "expires_at", "updated_at").
+		From("conversations").
+		Where(sq.Eq{"chat_id": chatID}).
+		QueryRowContext(ctx).
+		Scan(&c.ChatID, &c.Flow, &c.Step, &c.Data, &c.ExpiresAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Conversation{}, repository.ErrNotFound
+	}
+	return c, err
+}
+
+// ConversationSave creates or replaces the conversation of the user
+func (r *Repository) ConversationSave(ctx context.Context, c model.Conversation) error {
+	data := c.Data
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	_, err := r.psql.Builder().Insert("conversations").
+		Columns("chat_id", "flow", "step", "data", "expires_at", "updated_at").
+		Values(c.ChatID, c.Flow, c.Step, string(data), c.ExpiresAt.UTC(), time.Now().UTC()).
+		Suffix("ON CONFLICT (chat_id) DO UPDATE SET " + excludedSet([]string{"flow", "step", "data",
+			"expires_at", "updated_at"})).
+		ExecContext(ctx)
+	return err
+}
+
+// ConversationDelete deletes the conversation of the user
+func (r *Repository) ConversationDelete(ctx context.Context, chatID int64) error {
+	_, err := r.psql.Builder().Delete("conversations").
+		Where(sq.Eq{"chat_id": chatID}).
+		ExecContext(ctx)
+	return err
+}
+
+// ConversationsExpire deletes the conversations expired before the time and returns their number
+func (r *Repository) ConversationsExpire(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.psql.Builder().Delete("conversations").
+		Where(sq.Lt{"expires_at": before.UTC()}).
+		ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,184 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"time"
+)
+
+// CrawlRunCreate creates a new crawl run with its brands and returns its id.
+// Other running runs of the same mode are marked as failed.
+func (r *Repository) CrawlRunCreate(ctx context.Context, run model.CrawlRun) (int64, error) {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = r.psql.Builder().Update("crawl_runs").
+		Set("status", model.CrawlStatusFailed).
+		Set("error", "abandoned").
+		Set("finished_at", time.Now().UTC()).
+		Where(sq.Eq{"mode": run.Mode, "status": model.CrawlStatusRunning}).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = r.psql.Builder().Insert("crawl_runs").Columns("mode", "day", "status", "started_at").
+		Values(run.Mode, run.Day, run.Status, run.StartedAt).
+		Suffix("RETURNING id").
+		RunWith(tx).QueryRowContext(ctx).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	for _, brand := range run.Brands {
+		if err = r.crawlBrandSave(ctx, tx, id, brand); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// CrawlRunSave saves the status of the crawl run
+func (r *Repository) CrawlRunSave(ctx context.Context, run model.CrawlRun) error {
+	_, err := r.psql.Builder().Update("crawl_runs").
+		Set("status", run.Status).
+		Set("error", run.Error).
+		Set("finished_at", nullTime(run.FinishedAt)).
+		Where(sq.Eq{"id": run.ID}).
+		ExecContext(ctx)
+	return err
+}
+
+// CrawlBrandSave saves the progress of the brand within the crawl run
+func (r *Repository) CrawlBrandSave(ctx context.Context, runID int64, brand model.CrawlBrand) error {
+	return r.crawlBrandSave(ctx, nil, runID, brand)
+}
+
+// crawlBrandSave upserts the brand progress using the runner or the default connection if runner is nil
+func (r *Repository) crawlBrandSave(ctx context.Context, runner sq.BaseRunner, runID int64,
+	brand model.CrawlBrand) error {
+	q := r.psql.Builder().Insert("crawl_run_brands").
+		Columns("run_id", "brand", "status", "total_pages", "last_page", "error", "updated_at",
+			"pages", "ads_parsed", "ads_new", "ads_updated", "ads_unchanged", "ads_failed", "forbidden",
+			"duration_ms", "requests").
+		Values(runID, brand.Brand, brand.Status, brand.TotalPages, brand.LastPage, brand.Error, time.Now().UTC(),
+			brand.Pages, brand.Parsed, brand.New, brand.Updated, brand.Unchanged, brand.Failed, brand.Forbidden,
+			brand.Duration.Milliseconds(), brand.Requests).
+		Suffix("ON CONFLICT (run_id, brand) DO UPDATE SET status = excluded.status, " +
+			"total_pages = excluded.total_pages, last_page = excluded.last_page, error = excluded.error, " +
+			"updated_at = excluded.updated_at, pages = excluded.pages, ads_parsed = excluded.ads_parsed, " +
+			"ads_new = excluded.ads_new, ads_updated = excluded.ads_updated, " +
+			"ads_unchanged = excluded.ads_unchanged, ads_failed = excluded.ads_failed, " +
+			"forbidden = excluded.forbidden, duration_ms = excluded.duration_ms, requests = excluded.requests")
+	if runner != nil {
+		q = q.RunWith(runner)
+	}
+	_, err := q.ExecContext(ctx)
+	return err
+}
+
+// CrawlRunUnfinished returns the last running crawl run of the mode started on the day
+func (r *Repository) CrawlRunUnfinished(ctx context.Context, mode model.CrawlMode,
+	day time.Time) (model.CrawlRun, error) {
+	return r.crawlRun(ctx, sq.Eq{
+		"mode":   mode,
+		"day":    day.Format(time.DateOnly),
+		"status": model.CrawlStatusRunning,
+	})
+}
+
+// CrawlRunLast returns the last crawl run of the mode
+func (r *Repository) CrawlRunLast(ctx context.Context, mode model.CrawlMode) (model.CrawlRun, error) {
+	return r.crawlRun(ctx, sq.Eq{"mode": mode})
+}
+
+// CrawlRunCompletedBefore returns the last completed crawl run of the mode preceding the run
+func (r *Repository) CrawlRunCompletedBefore(ctx context.Context, mode model.CrawlMode,
+	runID int64) (model.CrawlRun, error) {
+	return r.crawlRun(ctx, sq.And{
+		sq.Eq{"mode": mode, "status": model.CrawlStatusCompleted},
+		sq.Lt{"id": runID},
+	})
+}
+
+// CrawlRuns returns the last limit crawl runs of all modes, the newest first
+func (r *Repository) CrawlRuns(ctx context.Context, limit int) ([]model.CrawlRun, error) {
+	return r.crawlRuns(ctx, sq.And{}, uint64(limit))
+}
+
+func (r *Repository) crawlRun(ctx context.Context, where sq.Sqlizer) (model.CrawlRun, error) {
+	runs, err := r.crawlRuns(ctx, where, 1)
+	if err != nil {
+		return model.CrawlRun{}, err
+	}
+	if len(runs) == 0 {
+		return model.CrawlRun{}, repository.ErrNotFound
+	}
+	return runs[0], nil
+}
+
+func (r *Repository) crawlRuns(ctx context.Context, where sq.Sqlizer, limit uint64) ([]model.CrawlRun, error) {
+	rows, err := r.psql.Builder().Select("id", "mode", "day", "status", "error", "started_at", "finished_at").
+		From("crawl_runs").
+		Where(where).
+		OrderBy("id DESC").
+		Limit(limit).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []model.CrawlRun
+	for rows.Next() {
+		var run model.CrawlRun
+		var finishedAt sql.NullTime
+		if err = rows.Scan(&run.ID, &run.Mode, &run.Day, &run.Status, &run.Error, &run.StartedAt,
+			&finishedAt); err != nil {
+			return nil, err
+		}
+		run.FinishedAt = finishedAt.Time
+		runs = append(runs, run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		if runs[i].Brands, err = r.crawlBrands(ctx, runs[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+func (r *Repository) crawlBrands(ctx context.Context, runID int64) ([]model.CrawlBrand, error) {
+	rows, err := r.psql.Builder().
+		Select("brand", "status", "total_pages", "last_page", "error", "updated_at", "pages", "ads_parsed",
+			"ads_new", "ads_updated", "ads_unchanged", "ads_failed", "forbidden", "duration_ms", "requests").
+		From("crawl_run_brands").
+		Where(sq.Eq{"run_id": runID}).
+		OrderBy("brand").
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var brands []model.CrawlBrand
+	for rows.Next() {
+		var brand model.CrawlBrand
+		var durationMs int64
+		if err = rows.Scan(&brand.Brand, &brand.Status, &brand.TotalPages, &brand.LastPage, &brand.Error,
+			&brand.UpdatedAt, &brand.Pages, &brand.Parsed, &brand.New, &brand.Updated, &brand.Unchanged,
+			&brand.Failed, &brand.Forbidden, &durationMs, &brand.Requests); err != nil {
+			return nil, err
+		}
+		brand.Duration = time.Duration(durationMs) * time.Millisecond
+		brands = append(brands, brand)
+	}
+	return brands, rows.Err()
+}
@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+)
+
+// DeliveredChats returns the chats the ads are successfully delivered to by ad id.
+// Only the deliveries of the events are taken into account if any given.
+func (r *Repository) DeliveredChats(ctx context.Context, adIDs []string,
+	events ...model.DeliveryEvent) (map[string][]int64, error) {
+	return r.chatsByStatus(ctx, adIDs, model.DeliverySent, events)
+}
+
+// AssumedChats returns the chats the ads are assumed to be delivered to by ad id, see model.DeliveryAssumed
+func (r *Repository) AssumedChats(ctx context.Context, adIDs []string) (map[string][]int64, error) {
+	return r.chatsByStatus(ctx, adIDs, model.DeliveryAssumed, nil)
+}
+
+func (r *Repository) chatsByStatus(ctx context.Context, adIDs []string, status model.DeliveryStatus,
+	events []model.DeliveryEvent) (map[string][]int64, error) {
+	chats := make(map[string][]int64)
+	if len(adIDs) == 0 {
+		return chats, nil
+	}
+	where := sq.And{
+		sq.Eq{"ad_id": adIDs},
+		sq.Eq{"status": status},
+	}
+	if len(events) > 0 {
+		where = append(where, sq.Eq{"event": events})
+	}
+	rows, err := r.psql.Builder().Select("DISTINCT ad_id", "chat_id").
+		From("deliveries").
+		Where(where).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var adID string
+		var chatID int64
+		if err = rows.Scan(&adID, &chatID); err != nil {
+			return nil, err
+		}
+		chats[adID] = append(chats[adID], chatID)
+	}
+	return chats, rows.Err()
+}
+
+func (r *Repository) saveDelivery(ctx context.Context, tx *sql.Tx, delivery model.Delivery) error {
+	_, err := r.psql.Builder().Insert("deliveries").
+		Columns("chat_id", "ad_id", "event", "status", "error", "delivered_at").
+		Values(delivery.ChatID, delivery.AdID, delivery.Event, delivery.Status, delivery.Error,
+			delivery.DeliveredAt.UTC()).
+		RunWith(tx).ExecContext(ctx)
+	return err
+}
@@ -0,0 +1,245 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/lib/pq"
+	"time"
+)
+
+// OutboxEnqueue adds the notifications to the outbox. The notifications already enqueued are skipped.
+// The notifications of the users receiving digests are held for the digest.
+func (r *Repository) OutboxEnqueue(ctx context.Context, jobs []model.OutboxJob) error {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = r.enqueue(ctx, tx, jobs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// OutboxClaim returns up to limit pending notifications due to be sent and postpones them for the lease time,
+// so the other dispatchers skip them and the notifications are retried if the claiming process dies.
+func (r *Repository) OutboxClaim(ctx context.Context, limit int, lease time.Duration) ([]model.OutboxJob, error) {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	rows, err := r.psql.Builder().
+		Select("id", "key", "chat_id", "coalesce(ad_id, '')", "event", "text", "photos", "status", "attempts",
+			"last_error").
+		From("outbox").
+		Where(outboxDue(now)).
+		OrderBy("id").
+		Limit(uint64(limit)).
+		Suffix("FOR UPDATE SKIP LOCKED").
+		RunWith(tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := make([]model.OutboxJob, 0, limit)
+	ids := make([]int64, 0, limit)
+	for rows.Next() {
+		var job model.OutboxJob
+		var photos pq.StringArray
+		if err = rows.Scan(&job.ID, &job.Key, &job.ChatID, &job.AdID, &job.Event, &job.Text, &photos,
+			&job.Status, &job.Attempts, &job.LastError); err != nil {
+			return nil, err
+		}
+		job.Photos = photos
+		job.Attempts++
+		job.NextAttemptAt = now.Add(lease)
+		jobs = append(jobs, job)
+		ids = append(ids, job.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return jobs, nil
+	}
+	_, err = r.psql.Builder().Update("outbox").
+		Set("attempts", sq.Expr("attempts + 1")).
+		Set("next_attempt_at", now.Add(lease)).
+		Set("updated_at", now).
+		Where(sq.Eq{"id": ids}).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, tx.Commit()
+}
+
+// OutboxSave saves the state of the claimed notification. The delivery is recorded once the notification
+// is sent or failed for good.
+func (r *Repository) OutboxSave(ctx context.Context, job model.OutboxJob) error {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = r.psql.Builder().Update("outbox").
+		Set("status", job.Status).
+		Set("next_attempt_at", job.NextAttemptAt.UTC()).
+		Set("last_error", job.LastError).
+		Set("updated_at", now).
+		Where(sq.Eq{"id": job.ID}).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if job.Status == model.OutboxPending {
+		return tx.Commit()
+	}
+	delivery := job.Delivery(now)
+	deliveries := make([]model.Delivery, 0, 1)
+	if job.AdID != "" {
+		deliveries = append(deliveries, delivery)
+	}
+	// the notifications bundled into the digest are delivered with it
+	rows, err := r.psql.Builder().Update("outbox").
+		Set("status", job.Status).
+		Set("last_error", job.LastError).
+		Set("updated_at", now).
+		Where(sq.Eq{"digest_id": job.ID, "status": model.OutboxBundled}).
+		Suffix("RETURNING ad_id, event").
+		RunWith(tx).QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		bundled := delivery
+		if err = rows.Scan(&bundled.AdID, &bundled.Event); err != nil {
+			return err
+		}
+		deliveries = append(deliveries, bundled)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, d := range deliveries {
+		if err = r.saveDelivery(ctx, tx, d); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// OutboxPurge deletes the notifications sent before the time and returns their number
+func (r *Repository) OutboxPurge(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.psql.Builder().Delete("outbox").
+		Where(sq.And{
+			sq.Eq{"status": model.OutboxSent},
+			sq.Lt{"updated_at": before.UTC()},
+		}).
+		ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// OutboxHeld returns the notifications held for the digests of the chats ordered by chat, brand and id
+func (r *Repository) OutboxHeld(ctx context.Context, chatIDs []int64) ([]model.OutboxJob, error) {
+	jobs := make([]model.OutboxJob, 0)
+	if len(chatIDs) == 0 {
+		return jobs, nil
+	}
+	rows, err := r.psql.Builder().
+		Select("id", "key", "chat_id", "ad_id", "event", "status", "brand", "summary", "price_change").
+		From("outbox").
+		Where(sq.Eq{"chat_id": chatIDs, "status": model.OutboxHeld}).
+		OrderBy("chat_id", "brand", "id").
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var job model.OutboxJob
+		if err = rows.Scan(&job.ID, &job.Key, &job.ChatID, &job.AdID, &job.Event, &job.Status, &job.Brand,
+			&job.Summary, &job.PriceChange); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// OutboxBundle enqueues the digests and bundles the held notifications of their Bundle into them.
+// The digests already enqueued are skipped.
+func (r *Repository) OutboxBundle(ctx context.Context, digests []model.OutboxJob) error {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, digest := range digests {
+		var id int64
+		err = r.psql.Builder().Insert("outbox").
+			Columns("key", "chat_id", "event", "text", "next_attempt_at").
+			Values(digest.Key, digest.ChatID, digest.Event, digest.Text, now).
+			Suffix("ON CONFLICT (key) DO NOTHING RETURNING id").
+			RunWith(tx).QueryRowContext(ctx).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = r.psql.Builder().Update("outbox").
+			Set("status", model.OutboxBundled).
+			Set("digest_id", id).
+			Set("updated_at", now).
+			Where(sq.Eq{"id": digest.Bundle, "status": model.OutboxHeld}).
+			RunWith(tx).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// outboxDue is the condition of the notifications due to be sent. The claimed notifications stay pending,
+// so they are due again once the lease expires.
+func outboxDue(now time.Time) sq.Sqlizer {
+	return sq.And{
+		sq.Eq{"status": model.OutboxPending},
+		sq.LtOrEq{"next_attempt_at": now},
+	}
+}
+
+func (r *Repository) enqueue(ctx context.Context, tx *sql.Tx, jobs []model.OutboxJob) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	q := r.psql.Builder().Insert("outbox").
+		Columns("key", "chat_id", "ad_id", "event", "text", "photos", "brand", "summary", "price_change",
+			"status", "next_attempt_at")
+	for _, job := range jobs {
+		status := sq.Expr("coalesce((SELECT CASE WHEN delivery_mode = ? THEN ? ELSE ? END "+
+			"FROM users WHERE chat_id = ?), ?)",
+			model.DeliveryInstant, model.OutboxPending, model.OutboxHeld, job.ChatID, model.OutboxPending)
+		q = q.Values(job.Key, job.ChatID, job.AdID, job.Event, job.Text, textArray(job.Photos), job.Brand,
+			job.Summary, job.PriceChange, status, now)
+	}
+	_, err := q.Suffix("ON CONFLICT (key) DO NOTHING").RunWith(tx).ExecContext(ctx)
+	return err
+}
@@ -0,0 +1,17 @@
+package postgres
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestOutboxDue(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	query, args, err := outboxDue(now).ToSql()
+	assert.NoError(t, err)
+	// the notification claimed by the crashed process stays pending and is reclaimed once the lease expires
+	assert.Equal(t, "(status = ? AND next_attempt_at <= ?)", query)
+	assert.Equal(t, []any{model.OutboxPending, now}, args)
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"context"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+)
+
+// SavePhotoHashes replaces the photo hashes of the ad
+func (r *Repository) SavePhotoHashes(ctx context.Context, adID string, hashes []model.PhotoHash) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	q := r.psql.Builder().Insert("ad_photo_hashes").Columns("ad_id", "position", "url", "dhash", "phash")
+	for _, hash := range hashes {
+		// hashes are stored as signed bigint bit by bit
+		q = q.Values(adID, hash.Position, hash.URL, int64(hash.DHash), int64(hash.PHash))
+	}
+	q = q.Suffix("ON CONFLICT (ad_id, position) DO UPDATE SET url = excluded.url, dhash = excluded.dhash, " +
+		"phash = excluded.phash, created_at = excluded.created_at")
+	_, err := q.ExecContext(ctx)
+	return err
+}
+
+// SimilarPhotoAds returns ids of other ads of the same manufacturer, model and year as the car
+// having a photo which perceptual and difference hashes are both within maxDistance bits from any of the hashes
+func (r *Repository) SimilarPhotoAds(ctx context.Context, car model.Car, hashes []model.PhotoHash,
+	maxDistance int) ([]string, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	rows, err := r.psql.Builder().Select("DISTINCT h.ad_id").From("ad_photo_hashes h").
+		// the candidates are narrowed down by the ads index before the hashes are compared
+		Join("ads a ON a.ad_id = h.ad_id").
+		Where(similarPhotos(car, hashes, maxDistance)).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var adIDs []string
+	for rows.Next() {
+		var adID string
+		if err = rows.Scan(&adID); err != nil {
+			return nil, err
+		}
+		adIDs = append(adIDs, adID)
+	}
+	return adIDs, rows.Err()
+}
+
+// AdsWithoutPhotoHashes returns up to limit ads ordered by id after the given one, which have photos
+// but no photo hashes. Only the ids and the photos of the ads are set.
+func (r *Repository) AdsWithoutPhotoHashes(ctx context.Context, afterAdID string, limit int) ([]model.Car, error) {
+	rows, err := r.psql.Builder().Select("a.ad_id").From("ads a").
+		Where(sq.And{
+			sq.Gt{"a.ad_id": afterAdID},
+			sq.Expr("EXISTS (SELECT 1 FROM ad_photos p WHERE p.ad_id = a.ad_id)"),
+			sq.Expr("NOT EXISTS (SELECT 1 FROM ad_photo_hashes h WHERE h.ad_id = a.ad_id)"),
+		}).
+		OrderBy("a.ad_id").
+		Limit(uint64(limit)).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cars := make([]model.Car, 0, limit)
+	for rows.Next() {
+		var car model.Car
+		if err = rows.Scan(&car.AdID); err != nil {
+			return nil, err
+		}
+		cars = append(cars, car)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(cars) == 0 {
+		return cars, nil
+	}
+	return cars, r.loadPhotos(ctx, cars)
+}
+
+// similarPhotos is the condition of the photo hashes of the other ads of the same manufacturer, model and year
+// as the car which are near any of the hashes
+func similarPhotos(car model.Car, hashes []model.PhotoHash, maxDistance int) sq.Sqlizer {
+	// the difference hash confirms the perceptual hash match of the same photo
+	near := make(sq.Or, 0, len(hashes))
+	for _, hash := range hashes {
+		near = append(near, sq.Expr("bit_count((h.phash # ?)::bit(64)) <= ? AND bit_count((h.dhash # ?)::bit(64)) <= ?",
+			int64(hash.PHash), maxDistance, int64(hash.DHash), maxDistance))
+	}
+	return sq.And{
+		sq.Eq{"a.manufacturer": car.Manufacturer, "a.model": car.Model, "a.year": car.Year},
+		sq.NotEq{"h.ad_id": car.AdID},
+		near,
+	}
+}
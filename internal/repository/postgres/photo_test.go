@@ -0,0 +1,24 @@
+package postgres
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSimilarPhotos(t *testing.T) {
+	car := model.Car{AdID: "100", Manufacturer: "Toyota", Model: "Corolla", Year: 2021}
+	hashes := []model.PhotoHash{
+		{Position: 0, PHash: 0xF0F0, DHash: 0x0F0F},
+		// the hashes with the highest bit set are stored as negative bigint
+		{Position: 1, PHash: 1 << 63, DHash: 1},
+	}
+	query, args, err := similarPhotos(car, hashes, 6).ToSql()
+	assert.NoError(t, err)
+	assert.Equal(t, "(a.manufacturer = ? AND a.model = ? AND a.year = ? AND h.ad_id <> ? AND "+
+		"(bit_count((h.phash # ?)::bit(64)) <= ? AND bit_count((h.dhash # ?)::bit(64)) <= ? OR "+
+		"bit_count((h.phash # ?)::bit(64)) <= ? AND bit_count((h.dhash # ?)::bit(64)) <= ?))", query)
+	assert.Equal(t, []any{"Toyota", "Corolla", 2021, "100",
+		int64(0xF0F0), 6, int64(0x0F0F), 6,
+		int64(-1 << 63), 6, int64(1), 6}, args)
+}
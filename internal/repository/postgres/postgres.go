@@ -10,24 +10,10 @@ import (
 	"github.com/bopoh24/bazacars/internal/model"
 	"github.com/bopoh24/bazacars/internal/repository"
 	"github.com/bopoh24/bazacars/pkg/sql/builder"
+	"strings"
 	"time"
 )
 
-var favouriteBrands = []string{
-	"BMW", "Mercedes-Benz", "Mazda", "Toyota", "Nissan",
-	"Audi", "Volkswagen", "Ford", "Honda", "Lexus",
-	"Jeep", "Volvo", "Infiniti", "Acura", "Land Rover", "Jaguar", "Mini",
-}
-
-var excludeModels = []string{"Fit", "2", "Yaris", "Aqua", "Sienta", "Polo", "CX-3", "Voxy", "Porte", "Yaris Cross", "C-HR", "Vezel"}
-
-const (
-	maxPrice      = 29000
-	minYear       = 2020
-	maxMileage    = 50000
-	minEngineSize = 1.5
-)
-
 type Repository struct {
 	psql *builder.Postgres
 }
@@ -44,26 +30,318 @@ func NewRepository(dbConf config.Postgres) (*Repository, error) {
 
 }
 
-// SaveCars saves cars to the database
-func (r *Repository) SaveCars(ctx context.Context, cars []model.Car) error {
-	q := r.psql.Builder().Insert("cars").Columns("manufacturer", "model", "year", "mileage", "engine",
-		"fuel", "drive", "automatic", "power", "color", "price", "description", "ad_id", "address", "link", "posted")
+// SaveCars saves cars with their sellers, equipment and photos to the database.
+// A snapshot is recorded only if the price, mileage or description of the ad changed,
+// the ids of the ads with a new snapshot are returned.
+func (r *Repository) SaveCars(ctx context.Context, cars []model.Car) ([]string, error) {
+	if len(cars) == 0 {
+		return nil, nil
+	}
+	cars = uniqueCars(cars)
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sellerIDs, err := r.saveSellers(ctx, tx, cars)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first seen price is the base of price change detection, it is not updated on conflict
+	q := r.psql.Builder().Insert("ads").Columns(append(adColumns, "notified_price")...)
 	for _, car := range cars {
-		q = q.Values(car.Manufacturer, car.Model, car.Year, car.Mileage, car.EngineSize, car.Fuel, car.Drive,
-			car.AutomaticGearbox, car.Power, car.Color, car.Price, car.Description, car.AdID,
-			car.Address, car.Link, car.Posted)
+		sellerID, ok := sellerIDs[car.Seller.Link]
+		q = q.Values(car.AdID, car.Manufacturer, car.Model, car.Year, car.EngineSize, car.Fuel, car.Drive,
+			car.AutomaticGearbox, car.Power, car.Color, car.Doors, car.Seats, car.BodyType, car.Condition,
+			nullTime(car.MOTTill), car.Availability, car.Address, car.Link, car.Posted,
+			sql.NullInt64{Int64: sellerID, Valid: ok}, car.Seller.Dealer, car.Price)
 	}
-	q = q.Suffix("ON CONFLICT (ad_id, parsed) DO NOTHING")
-	_, err := q.ExecContext(ctx)
+	q = q.Suffix("ON CONFLICT (ad_id) DO UPDATE SET " + excludedSet(adColumns[1:]) + ", last_seen = current_date")
+	if _, err = q.RunWith(tx).ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	changed, err := r.saveSnapshots(ctx, tx, cars)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.saveEquipment(ctx, tx, cars); err != nil {
+		return nil, err
+	}
+	if err = r.savePhotos(ctx, tx, cars); err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
+
+// saveSnapshots records today's snapshot of the cars which price, mileage or description
+// differ from the last snapshot and returns the ids of these cars
+func (r *Repository) saveSnapshots(ctx context.Context, tx *sql.Tx, cars []model.Car) ([]string, error) {
+	rows, err := r.psql.Builder().Select("ad_id", "price", "mileage", "description").
+		From("ads_current").
+		Where(sq.Eq{"ad_id": adIDs(cars)}).
+		RunWith(tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	last := make(map[string]model.Car)
+	for rows.Next() {
+		var car model.Car
+		if err = rows.Scan(&car.AdID, &car.Price, &car.Mileage, &car.Description); err != nil {
+			return nil, err
+		}
+		last[car.AdID] = car
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	q := r.psql.Builder().Insert("ad_snapshots").Columns("ad_id", "price", "mileage", "description")
+	var changed []string
+	for _, car := range cars {
+		prev, ok := last[car.AdID]
+		if ok && prev.Price == car.Price && prev.Mileage == car.Mileage && prev.Description == car.Description {
+			continue
+		}
+		q = q.Values(car.AdID, car.Price, car.Mileage, car.Description)
+		changed = append(changed, car.AdID)
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	q = q.Suffix("ON CONFLICT (ad_id, parsed) DO UPDATE SET price = excluded.price, " +
+		"mileage = excluded.mileage, description = excluded.description")
+	if _, err = q.RunWith(tx).ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// saveSellers upserts sellers of the cars and returns their ids by profile link.
+// Sellers without profile link are not saved, the dealer flag of their ads is kept on the ads.
+func (r *Repository) saveSellers(ctx context.Context, tx *sql.Tx, cars []model.Car) (map[string]int64, error) {
+	result := make(map[string]int64)
+	q := r.psql.Builder().Insert("sellers").Columns("link", "name", "verified", "dealer", "updated_at")
+	hasValues := false
+	for _, car := range cars {
+		if car.Seller.Link == "" {
+			continue
+		}
+		if _, ok := result[car.Seller.Link]; ok {
+			continue
+		}
+		result[car.Seller.Link] = 0
+		q = q.Values(car.Seller.Link, car.Seller.Name, car.Seller.Verified, car.Seller.Dealer, time.Now().UTC())
+		hasValues = true
+	}
+	if !hasValues {
+		return result, nil
+	}
+	q = q.Suffix("ON CONFLICT (link) DO UPDATE SET name = excluded.name, verified = excluded.verified, " +
+		"dealer = excluded.dealer, updated_at = excluded.updated_at RETURNING id, link")
+	rows, err := q.RunWith(tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var link string
+		if err = rows.Scan(&id, &link); err != nil {
+			return nil, err
+		}
+		result[link] = id
+	}
+	return result, rows.Err()
+}
+
+// saveEquipment saves the equipment of the cars
+func (r *Repository) saveEquipment(ctx context.Context, tx *sql.Tx, cars []model.Car) error {
+	q := r.psql.Builder().Insert("ad_equipment").Columns("ad_id", "equipment")
+	hasValues := false
+	for _, car := range cars {
+		for _, equipment := range car.Equipment {
+			q = q.Values(car.AdID, equipment)
+			hasValues = true
+		}
+	}
+	if !hasValues {
+		return nil
+	}
+	q = q.Suffix("ON CONFLICT (ad_id, equipment) DO NOTHING")
+	_, err := q.RunWith(tx).ExecContext(ctx)
+	return err
+}
+
+// savePhotos replaces the photos of the cars
+func (r *Repository) savePhotos(ctx context.Context, tx *sql.Tx, cars []model.Car) error {
+	_, err := r.psql.Builder().Delete("ad_photos").Where(sq.Eq{"ad_id": adIDs(cars)}).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	q := r.psql.Builder().Insert("ad_photos").Columns("ad_id", "position", "url")
+	hasValues := false
+	for _, car := range cars {
+		for i, photo := range car.Photos {
+			q = q.Values(car.AdID, i, photo)
+			hasValues = true
+		}
+	}
+	if !hasValues {
+		return nil
+	}
+	_, err = q.RunWith(tx).ExecContext(ctx)
+	return err
+}
+
+// loadAdsData fills the equipment, sellers, previous listings and photos of the cars
+func (r *Repository) loadAdsData(ctx context.Context, cars []model.Car) error {
+	if len(cars) == 0 {
+		return nil
+	}
+	if err := r.loadEquipment(ctx, cars); err != nil {
+		return err
+	}
+	if err := r.loadSellers(ctx, cars); err != nil {
+		return err
+	}
+	if err := r.loadPreviousListings(ctx, cars); err != nil {
+		return err
+	}
+	return r.loadPhotos(ctx, cars)
+}
+
+// loadSellers fills the sellers of the cars. The ads without stored seller get the dealer flag only.
+func (r *Repository) loadSellers(ctx context.Context, cars []model.Car) error {
+	q := r.psql.Builder().Select("a.ad_id", "coalesce(s.name, '')", "coalesce(s.verified, false)", "a.dealer",
+		"coalesce(s.link, '')").
+		From("ads a").
+		LeftJoin("sellers s ON s.id = a.seller_id").
+		Where(sq.Eq{"a.ad_id": adIDs(cars)})
+	rows, err := q.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	sellers := make(map[string]model.Seller)
+	for rows.Next() {
+		var adID string
+		var seller model.Seller
+		if err = rows.Scan(&adID, &seller.Name, &seller.Verified, &seller.Dealer, &seller.Link); err != nil {
+			return err
+		}
+		sellers[adID] = seller
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i := range cars {
+		if seller, ok := sellers[cars[i].AdID]; ok {
+			cars[i].Seller = seller
+		}
+	}
+	return nil
+}
+
+// loadPhotos fills the photos of the cars
+func (r *Repository) loadPhotos(ctx context.Context, cars []model.Car) error {
+	q := r.psql.Builder().Select("ad_id", "url").From("ad_photos").
+		Where(sq.Eq{"ad_id": adIDs(cars)}).OrderBy("ad_id", "position")
+	rows, err := q.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	photos := make(map[string][]string)
+	for rows.Next() {
+		var adID, photo string
+		if err = rows.Scan(&adID, &photo); err != nil {
+			return err
+		}
+		photos[adID] = append(photos[adID], photo)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i := range cars {
+		cars[i].Photos = photos[cars[i].AdID]
+	}
+	return nil
+}
+
+// loadEquipment fills the equipment of the cars
+func (r *Repository) loadEquipment(ctx context.Context, cars []model.Car) error {
+	q := r.psql.Builder().Select("ad_id", "equipment").From("ad_equipment").
+		Where(sq.Eq{"ad_id": adIDs(cars)}).OrderBy("ad_id", "equipment")
+	rows, err := q.QueryContext(ctx)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+	equipment := make(map[string][]model.Equipment)
+	for rows.Next() {
+		var adID string
+		var item model.Equipment
+		if err = rows.Scan(&adID, &item); err != nil {
+			return err
+		}
+		equipment[adID] = append(equipment[adID], item)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i := range cars {
+		cars[i].Equipment = equipment[cars[i].AdID]
+	}
 	return nil
 }
 
+// LastSnapshots returns the current price, posting date and the last seen date of the ads by ad id
+func (r *Repository) LastSnapshots(ctx context.Context, adIDs []string) (map[string]model.Car, error) {
+	result := make(map[string]model.Car)
+	if len(adIDs) == 0 {
+		return result, nil
+	}
+	q := r.psql.Builder().Select("ad_id", "price", "posted", "last_seen").
+		From("ads_current").
+		Where(sq.Eq{"ad_id": adIDs})
+	rows, err := q.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var car model.Car
+		if err = rows.Scan(&car.AdID, &car.Price, &car.Posted, &car.Parsed); err != nil {
+			return nil, err
+		}
+		result[car.AdID] = car
+	}
+	return result, rows.Err()
+}
+
+// MarkAdsSeen records that the unchanged ads are still listed today
+func (r *Repository) MarkAdsSeen(ctx context.Context, adIDs []string) error {
+	if len(adIDs) == 0 {
+		return nil
+	}
+	_, err := r.psql.Builder().Update("ads").
+		Set("last_seen", sq.Expr("current_date")).
+		Where(sq.Eq{"ad_id": adIDs}).
+		ExecContext(ctx)
+	return err
+}
+
+// userColumns are the columns of the user in the order they are scanned
+var userColumns = []string{"chat_id", "username", "first_name", "last_name", "approved", "admin",
+	"delivery_mode", "digest_hour", "updated_at", "created_at"}
+
 // Users returns all users
 func (r *Repository) Users(ctx context.Context) ([]model.User, error) {
-	q := r.psql.Builder().Select("*").From("users")
+	q := r.psql.Builder().Select(userColumns...).From("users")
 	rows, err := q.QueryContext(ctx)
 	if err != nil {
 		return nil, err
@@ -73,7 +351,8 @@ func (r *Repository) Users(ctx context.Context) ([]model.User, error) {
 	for rows.Next() {
 		var user model.User
 		if err = rows.Scan(&user.ChatID, &user.Username, &user.FirstName, &user.LastName,
-			&user.Approved, &user.Admin, &user.UpdatedAt, &user.CreatedAt); err != nil {
+			&user.Approved, &user.Admin, &user.DeliveryMode, &user.DigestHour,
+			&user.UpdatedAt, &user.CreatedAt); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return nil, repository.ErrNotFound
 			}
@@ -85,11 +364,11 @@ func (r *Repository) Users(ctx context.Context) ([]model.User, error) {
 }
 
 func (r *Repository) User(ctx context.Context, chatID int64) (model.User, error) {
-	q := r.psql.Builder().Select("*").From("users").Where(sq.Eq{"chat_id": chatID})
+	q := r.psql.Builder().Select(userColumns...).From("users").Where(sq.Eq{"chat_id": chatID})
 	row := q.QueryRowContext(ctx)
 	var user model.User
 	if err := row.Scan(&user.ChatID, &user.Username, &user.FirstName, &user.LastName, &user.Approved,
-		&user.Admin, &user.UpdatedAt, &user.CreatedAt); err != nil {
+		&user.Admin, &user.DeliveryMode, &user.DigestHour, &user.UpdatedAt, &user.CreatedAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return model.User{}, repository.ErrNotFound
 		}
@@ -99,7 +378,7 @@ func (r *Repository) User(ctx context.Context, chatID int64) (model.User, error)
 }
 
 func (r *Repository) Admins(ctx context.Context) ([]model.User, error) {
-	q := r.psql.Builder().Select("*").From("users").Where(sq.Eq{"admin": true})
+	q := r.psql.Builder().Select(userColumns...).From("users").Where(sq.Eq{"admin": true})
 	rows, err := q.QueryContext(ctx)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -112,7 +391,7 @@ func (r *Repository) Admins(ctx context.Context) ([]model.User, error) {
 	for rows.Next() {
 		var user model.User
 		err = rows.Scan(&user.ChatID, &user.Username, &user.FirstName, &user.LastName,
-			&user.Approved, &user.Admin, &user.UpdatedAt, &user.CreatedAt)
+			&user.Approved, &user.Admin, &user.DeliveryMode, &user.DigestHour, &user.UpdatedAt, &user.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -148,22 +427,54 @@ func (r *Repository) UserSave(ctx context.Context, user model.User) error {
 	return err
 }
 
+// UserDeliverySave saves the delivery mode of the user. The notifications held for the digest are released
+// if the user switches to instant delivery.
+func (r *Repository) UserDeliverySave(ctx context.Context, chatID int64, mode model.DeliveryMode,
+	digestHour int) error {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	res, err := r.psql.Builder().Update("users").
+		Set("delivery_mode", mode).
+		Set("digest_hour", digestHour).
+		Set("updated_at", now).
+		Where(sq.Eq{"chat_id": chatID}).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		return errors.Join(err, repository.ErrNotFound)
+	}
+	if mode == model.DeliveryInstant {
+		_, err = r.psql.Builder().Update("outbox").
+			Set("status", model.OutboxPending).
+			Set("next_attempt_at", now).
+			Set("updated_at", now).
+			Where(sq.Eq{"chat_id": chatID, "status": model.OutboxHeld}).
+			RunWith(tx).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// NewAds returns today's ads posted since yesterday.
+// The ads are matched against the subscriptions and the deliveries by the caller.
 func (r *Repository) NewAds(ctx context.Context) ([]model.Car, error) {
 	q := r.psql.Builder().Select("manufacturer", "model", "year", "mileage", "engine", "fuel", "drive", "automatic",
-		"power", "color", "price", "description", "ad_id", "address", "link", "posted").Distinct().
-		From("cars").
+		"power", "color", "price", "description", "ad_id", "address", "link", "posted",
+		"doors", "seats", "body_type", "condition", "mot_till", "availability").
+		From("ads_current").
 		Where(
 			sq.And{
-				sq.Eq{"manufacturer": favouriteBrands},
-				sq.NotEq{"model": excludeModels},
-				sq.LtOrEq{"price": maxPrice},
-				sq.LtOrEq{"mileage": maxMileage},
-				sq.GtOrEq{"year": minYear},
-				sq.GtOrEq{"engine": minEngineSize},
-				sq.Eq{"automatic": true},
 				sq.GtOrEq{"posted": time.Now().AddDate(0, 0, -1).Format("2006-01-02")},
-				sq.GtOrEq{"parsed": time.Now().Format("2006-01-02")},
-				sq.Eq{"sent": false},
+				sq.GtOrEq{"last_seen": time.Now().Format("2006-01-02")},
 			},
 		).OrderBy("manufacturer", "model")
 
@@ -178,60 +489,95 @@ func (r *Repository) NewAds(ctx context.Context) ([]model.Car, error) {
 	cars := make([]model.Car, 0)
 	for rows.Next() {
 		var car model.Car
+		var motTill sql.NullTime
 		if err = rows.Scan(&car.Manufacturer, &car.Model, &car.Year, &car.Mileage, &car.EngineSize, &car.Fuel,
 			&car.Drive, &car.AutomaticGearbox, &car.Power, &car.Color, &car.Price, &car.Description, &car.AdID,
-			&car.Address, &car.Link, &car.Posted); err != nil {
+			&car.Address, &car.Link, &car.Posted,
+			&car.Doors, &car.Seats, &car.BodyType, &car.Condition, &motTill, &car.Availability); err != nil {
 			return nil, err
 		}
+		car.MOTTill = motTill.Time
 		cars = append(cars, car)
 	}
+	if err = r.loadAdsData(ctx, cars); err != nil {
+		return nil, err
+	}
 	return cars, nil
 }
 
-// UpdateSent updates the sent field in the database
-func (r *Repository) UpdateSent(ctx context.Context) error {
-	q := r.psql.Builder().Update("cars").Set("sent", true).
-		Where(sq.Expr("ad_id in (?)",
-			sq.Select("ad_id").Distinct().From("cars").Where(sq.Eq{"sent": true})))
-	_, err := q.ExecContext(ctx)
+// PriceNotified records the price subscribers are notified about and enqueues the notifications
+func (r *Repository) PriceNotified(ctx context.Context, adID string, price int, jobs []model.OutboxJob) error {
+	tx, err := r.psql.Tx(ctx)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return repository.ErrNotFound
-		}
+		return err
 	}
-	return err
+	defer tx.Rollback()
+
+	if err = r.enqueue(ctx, tx, jobs); err != nil {
+		return err
+	}
+	_, err = r.psql.Builder().Update("ads").
+		Set("notified_price", price).
+		Where(sq.Eq{"ad_id": adID}).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// AdSent marks the ad as sent
-func (r *Repository) AdSent(ctx context.Context, adId string) error {
-	q := r.psql.Builder().Update("cars").Set("sent", true).Where(sq.Eq{"ad_id": adId})
-	_, err := q.ExecContext(ctx)
+// PriceHistory returns the price changes of the ad from the first snapshot to the last one
+func (r *Repository) PriceHistory(ctx context.Context, adID string) ([]model.PricePoint, error) {
+	rows, err := r.psql.Builder().Select("parsed", "price").
+		From("ad_snapshots").
+		Where(sq.Eq{"ad_id": adID}).
+		OrderBy("parsed").
+		QueryContext(ctx)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return repository.ErrNotFound
+		return nil, err
+	}
+	defer rows.Close()
+	var snapshots []model.PricePoint
+	for rows.Next() {
+		var point model.PricePoint
+		if err = rows.Scan(&point.Date, &point.Price); err != nil {
+			return nil, err
 		}
+		snapshots = append(snapshots, point)
 	}
-	return err
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, repository.ErrNotFound
+	}
+	return priceChanges(snapshots), nil
 }
 
-// AdsWithNewPrice marks the ad as sent and updates the price
+// priceChanges returns the snapshot prices without the repeated ones,
+// snapshots also record mileage and description changes
+func priceChanges(snapshots []model.PricePoint) []model.PricePoint {
+	history := make([]model.PricePoint, 0, len(snapshots))
+	for _, point := range snapshots {
+		if len(history) > 0 && history[len(history)-1].Price == point.Price {
+			continue
+		}
+		history = append(history, point)
+	}
+	return history
+}
+
+// AdsWithNewPrice returns the listed ads which price differs from the price subscribers last know about.
+// OldPrice of the cars is the last notified price.
 func (r *Repository) AdsWithNewPrice(ctx context.Context) ([]model.Car, error) {
-	q := r.psql.Builder().Select("lc.manufacturer, lc.model, lc.year, lc.mileage, lc.engine, lc.fuel, " +
-		"lc.drive, lc.automatic, lc.power, lc.color, lc.price, rc.price as old_price, " +
-		"lc.description, lc.ad_id, lc.address, lc.link, lc.posted").
-		From("cars as lc").
-		Join("cars as rc ON lc.ad_id = rc.ad_id").
+	q := r.psql.Builder().Select("c.manufacturer, c.model, c.year, c.mileage, c.engine, c.fuel, " +
+		"c.drive, c.automatic, c.power, c.color, c.price, c.notified_price as old_price, " +
+		"c.description, c.ad_id, c.address, c.link, c.posted, " +
+		"c.doors, c.seats, c.body_type, c.condition, c.mot_till, c.availability").
+		From("ads_current as c").
 		Where(sq.And{
-			sq.Expr("rc.price != lc.price"),
-			sq.Eq{"lc.manufacturer": favouriteBrands},
-			sq.NotEq{"lc.model": excludeModels},
-			sq.LtOrEq{"lc.price": maxPrice},
-			sq.LtOrEq{"lc.mileage": maxMileage},
-			sq.GtOrEq{"lc.year": minYear},
-			sq.Eq{"lc.automatic": true},
-			sq.GtOrEq{"lc.engine": minEngineSize},
-			sq.Eq{"lc.parsed": time.Now().Format("2006-01-02")},
-			sq.Eq{"rc.parsed": time.Now().AddDate(0, 0, -1).Format("2006-01-02")},
+			sq.Expr("c.notified_price != c.price"),
+			sq.Eq{"c.last_seen": time.Now().Format("2006-01-02")},
 		})
 	rows, err := q.QueryContext(ctx)
 	if err != nil {
@@ -244,16 +590,65 @@ func (r *Repository) AdsWithNewPrice(ctx context.Context) ([]model.Car, error) {
 	cars := make([]model.Car, 0)
 	for rows.Next() {
 		var car model.Car
+		var motTill sql.NullTime
 		if err = rows.Scan(&car.Manufacturer, &car.Model, &car.Year, &car.Mileage, &car.EngineSize, &car.Fuel,
 			&car.Drive, &car.AutomaticGearbox, &car.Power, &car.Color, &car.Price, &car.OldPrice, &car.Description, &car.AdID,
-			&car.Address, &car.Link, &car.Posted); err != nil {
+			&car.Address, &car.Link, &car.Posted,
+			&car.Doors, &car.Seats, &car.BodyType, &car.Condition, &motTill, &car.Availability); err != nil {
 			return nil, err
 		}
+		car.MOTTill = motTill.Time
 		cars = append(cars, car)
 	}
+	if err = r.loadAdsData(ctx, cars); err != nil {
+		return nil, err
+	}
 	return cars, nil
 }
 
+// adColumns are the columns of the stable ad attributes, ad_id first
+var adColumns = []string{"ad_id", "manufacturer", "model", "year", "engine", "fuel", "drive", "automatic",
+	"power", "color", "doors", "seats", "body_type", "condition", "mot_till", "availability", "address", "link",
+	"posted", "seller_id", "dealer"}
+
+// excludedSet returns the SET clause updating the columns to the values of the conflicting insert
+func excludedSet(columns []string) string {
+	set := make([]string, 0, len(columns))
+	for _, column := range columns {
+		set = append(set, column+" = excluded."+column)
+	}
+	return strings.Join(set, ", ")
+}
+
+// uniqueCars returns the cars with distinct ad ids keeping the last one of the duplicates
+func uniqueCars(cars []model.Car) []model.Car {
+	index := make(map[string]int, len(cars))
+	result := make([]model.Car, 0, len(cars))
+	for _, car := range cars {
+		if i, ok := index[car.AdID]; ok {
+			result[i] = car
+			continue
+		}
+		index[car.AdID] = len(result)
+		result = append(result, car)
+	}
+	return result
+}
+
+// adIDs returns ad ids of the cars
+func adIDs(cars []model.Car) []string {
+	result := make([]string, 0, len(cars))
+	for _, car := range cars {
+		result = append(result, car.AdID)
+	}
+	return result
+}
+
+// nullTime converts zero time to NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
 // Close closes the repository
 func (r *Repository) Close(ctx context.Context) error {
 	return r.psql.Close()
@@ -0,0 +1,26 @@
+package postgres
+
+import (
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPriceChanges(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC)
+	}
+	// the price is unchanged, the snapshots record mileage changes
+	assert.Equal(t, []model.PricePoint{{Date: day(1), Price: 20000}}, priceChanges([]model.PricePoint{
+		{Date: day(1), Price: 20000}, {Date: day(3), Price: 20000}, {Date: day(5), Price: 20000},
+	}))
+	// several changes, the price may come back
+	assert.Equal(t, []model.PricePoint{
+		{Date: day(1), Price: 20000}, {Date: day(4), Price: 19000}, {Date: day(6), Price: 20000},
+	}, priceChanges([]model.PricePoint{
+		{Date: day(1), Price: 20000}, {Date: day(2), Price: 20000}, {Date: day(4), Price: 19000},
+		{Date: day(5), Price: 19000}, {Date: day(6), Price: 20000},
+	}))
+	assert.Empty(t, priceChanges(nil))
+}
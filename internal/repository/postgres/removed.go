@@ -0,0 +1,117 @@
+package postgres
+
+import (
+	"context"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+	"time"
+)
+
+// MarkRemovedAds marks as removed on the day the ads last seen since seenSince but not seen on the day.
+// The ads seen on the day again are no longer removed. It returns the number of removed ads.
+func (r *Repository) MarkRemovedAds(ctx context.Context, seenSince, day time.Time) (int64, error) {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	dayStr := day.Format(time.DateOnly)
+	// relisted ads
+	_, err = r.psql.Builder().Delete("removed_ads").
+		Where("ad_id IN (SELECT ad_id FROM ads WHERE last_seen >= ?)", dayStr).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	listedSince := "least(posted::date, first_seen)"
+	missing := r.psql.Builder().
+		Select("ad_id", listedSince, "last_seen").
+		Column("?::date", dayStr).
+		Column("?::date - "+listedSince, dayStr).
+		// ads never delivered to anybody need no notification
+		Column("NOT EXISTS (SELECT 1 FROM deliveries d WHERE d.ad_id = ads.ad_id AND d.status IN (?, ?))",
+			model.DeliverySent, model.DeliveryAssumed).
+		From("ads").
+		Where(sq.And{
+			sq.GtOrEq{"last_seen": seenSince.Format(time.DateOnly)},
+			sq.Lt{"last_seen": dayStr},
+		})
+	res, err := r.psql.Builder().Insert("removed_ads").
+		Columns("ad_id", "listed_since", "last_seen", "removed_on", "days_listed", "notified").
+		Select(missing).
+		Suffix("ON CONFLICT (ad_id) DO NOTHING").
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return removed, tx.Commit()
+}
+
+// RemovedAds returns the removed ads which subscribers are not notified about
+func (r *Repository) RemovedAds(ctx context.Context) ([]model.RemovedAd, error) {
+	q := r.psql.Builder().Select("c.manufacturer", "c.model", "c.year", "c.mileage",
+		"c.engine", "c.fuel", "c.drive", "c.automatic", "c.price", "c.ad_id", "c.address", "c.link", "c.posted",
+		"a.dealer", "ra.listed_since", "ra.last_seen", "ra.removed_on", "ra.days_listed").
+		From("removed_ads ra").
+		Join("ads_current c ON c.ad_id = ra.ad_id").
+		Join("ads a ON a.ad_id = c.ad_id").
+		Where(sq.Eq{"ra.notified": false}).
+		OrderBy("c.ad_id")
+	rows, err := q.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ads := make([]model.RemovedAd, 0)
+	for rows.Next() {
+		var ad model.RemovedAd
+		if err = rows.Scan(&ad.Manufacturer, &ad.Model, &ad.Year, &ad.Mileage, &ad.EngineSize, &ad.Fuel,
+			&ad.Drive, &ad.AutomaticGearbox, &ad.Price, &ad.AdID, &ad.Address, &ad.Link, &ad.Posted,
+			&ad.Seller.Dealer, &ad.ListedSince, &ad.LastSeen, &ad.RemovedOn, &ad.DaysListed); err != nil {
+			return nil, err
+		}
+		ads = append(ads, ad)
+	}
+	if err = rows.Err(); err != nil || len(ads) == 0 {
+		return ads, err
+	}
+	// the equipment is needed to match the ads with subscriptions
+	cars := make([]model.Car, len(ads))
+	for i := range ads {
+		cars[i] = ads[i].Car
+	}
+	if err = r.loadEquipment(ctx, cars); err != nil {
+		return nil, err
+	}
+	for i := range ads {
+		ads[i].Equipment = cars[i].Equipment
+	}
+	return ads, nil
+}
+
+// RemovedAdNotified marks subscribers notified about the removed ad and enqueues the notifications
+func (r *Repository) RemovedAdNotified(ctx context.Context, adID string, jobs []model.OutboxJob) error {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = r.enqueue(ctx, tx, jobs); err != nil {
+		return err
+	}
+	_, err = r.psql.Builder().Update("removed_ads").
+		Set("notified", true).
+		Where(sq.Eq{"ad_id": adID}).
+		RunWith(tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
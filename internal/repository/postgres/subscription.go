@@ -0,0 +1,164 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"github.com/lib/pq"
+	"time"
+)
+
+var subscriptionColumns = []string{"chat_id", "name", "brands", "exclude_brands", "models", "exclude_models",
+	"min_price", "max_price", "min_year", "max_year", "min_mileage", "max_mileage", "min_engine", "max_engine",
+	"fuels", "gearbox", "drives", "districts", "sellers", "equipment"}
+
+// ActiveSubscriptions returns the subscriptions of approved users
+func (r *Repository) ActiveSubscriptions(ctx context.Context) ([]model.Subscription, error) {
+	return r.subscriptions(ctx, r.subscriptionsQuery().
+		Join("users u ON u.chat_id = s.chat_id").
+		Where(sq.Eq{"u.approved": true}))
+}
+
+// Subscriptions returns the subscriptions of the user
+func (r *Repository) Subscriptions(ctx context.Context, chatID int64) ([]model.Subscription, error) {
+	return r.subscriptions(ctx, r.subscriptionsQuery().Where(sq.Eq{"s.chat_id": chatID}))
+}
+
+// Subscription returns the subscription of the user by id
+func (r *Repository) Subscription(ctx context.Context, chatID, id int64) (model.Subscription, error) {
+	subscriptions, err := r.subscriptions(ctx, r.subscriptionsQuery().
+		Where(sq.Eq{"s.chat_id": chatID, "s.id": id}))
+	if err != nil {
+		return model.Subscription{}, err
+	}
+	if len(subscriptions) == 0 {
+		return model.Subscription{}, repository.ErrNotFound
+	}
+	return subscriptions[0], nil
+}
+
+// SubscriptionSave creates the subscription if its id is zero or updates it otherwise and returns its id
+func (r *Repository) SubscriptionSave(ctx context.Context, s model.Subscription) (int64, error) {
+	values := []any{s.ChatID, s.Name, textArray(s.Brands), textArray(s.ExcludeBrands),
+		textArray(s.Models), textArray(s.ExcludeModels), s.MinPrice, s.MaxPrice, s.MinYear, s.MaxYear,
+		s.MinMileage, s.MaxMileage, s.MinEngine, s.MaxEngine, textArray(s.Fuels), s.Gearbox, textArray(s.Drives),
+		textArray(s.Districts), sellerFilter(s.Sellers), textArray(s.Equipment)}
+	if s.ID == 0 {
+		var id int64
+		err := r.psql.Builder().Insert("subscriptions").Columns(subscriptionColumns...).Values(values...).
+			Suffix("RETURNING id").
+			QueryRowContext(ctx).Scan(&id)
+		return id, err
+	}
+	q := r.psql.Builder().Update("subscriptions").Set("updated_at", time.Now().UTC()).
+		Where(sq.Eq{"id": s.ID, "chat_id": s.ChatID})
+	for i, column := range subscriptionColumns {
+		q = q.Set(column, values[i])
+	}
+	res, err := q.ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		return 0, errors.Join(err, repository.ErrNotFound)
+	}
+	return s.ID, nil
+}
+
+// SubscriptionDelete deletes the subscription of the user
+func (r *Repository) SubscriptionDelete(ctx context.Context, chatID, id int64) error {
+	_, err := r.psql.Builder().Delete("subscriptions").
+		Where(sq.Eq{"id": id, "chat_id": chatID}).
+		ExecContext(ctx)
+	return err
+}
+
+// Models returns the models of the brands seen during the last year ordered by name
+func (r *Repository) Models(ctx context.Context, brands []string) ([]string, error) {
+	rows, err := r.psql.Builder().Select("DISTINCT model").
+		From("ads").
+		Where(sq.And{
+			sq.Eq{"manufacturer": brands},
+			sq.GtOrEq{"last_seen": time.Now().AddDate(-1, 0, 0).Format(time.DateOnly)},
+		}).
+		OrderBy("model").
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	models := make([]string, 0)
+	for rows.Next() {
+		var m string
+		if err = rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		models = append(models, m)
+	}
+	return models, rows.Err()
+}
+
+func (r *Repository) subscriptionsQuery() sq.SelectBuilder {
+	columns := make([]string, 0, len(subscriptionColumns)+3)
+	columns = append(columns, "s.id")
+	for _, column := range subscriptionColumns {
+		columns = append(columns, "s."+column)
+	}
+	columns = append(columns, "s.created_at", "s.updated_at")
+	return r.psql.Builder().Select(columns...).From("subscriptions s").OrderBy("s.chat_id", "s.id")
+}
+
+func (r *Repository) subscriptions(ctx context.Context, q sq.SelectBuilder) ([]model.Subscription, error) {
+	rows, err := q.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subscriptions := make([]model.Subscription, 0)
+	for rows.Next() {
+		var s model.Subscription
+		var fuels, drives, equipment []string
+		if err = rows.Scan(&s.ID, &s.ChatID, &s.Name, (*pq.StringArray)(&s.Brands),
+			(*pq.StringArray)(&s.ExcludeBrands), (*pq.StringArray)(&s.Models), (*pq.StringArray)(&s.ExcludeModels),
+			&s.MinPrice, &s.MaxPrice, &s.MinYear, &s.MaxYear, &s.MinMileage, &s.MaxMileage, &s.MinEngine,
+			&s.MaxEngine, (*pq.StringArray)(&fuels), &s.Gearbox, (*pq.StringArray)(&drives),
+			(*pq.StringArray)(&s.Districts), &s.Sellers, (*pq.StringArray)(&equipment), &s.CreatedAt,
+			&s.UpdatedAt); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, repository.ErrNotFound
+			}
+			return nil, err
+		}
+		for _, fuel := range fuels {
+			s.Fuels = append(s.Fuels, model.FuelType(fuel))
+		}
+		for _, drive := range drives {
+			s.Drives = append(s.Drives, model.DriveType(drive))
+		}
+		for _, item := range equipment {
+			s.Equipment = append(s.Equipment, model.Equipment(item))
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// textArray converts the items to a not null text array
+func textArray[T ~string](items []T) pq.StringArray {
+	result := make(pq.StringArray, 0, len(items))
+	for _, item := range items {
+		result = append(result, string(item))
+	}
+	return result
+}
+
+// sellerFilter returns the stored value of the seller filter
+func sellerFilter(filter model.SellerFilter) model.SellerFilter {
+	if filter == "" {
+		return model.SellerAny
+	}
+	return filter
+}
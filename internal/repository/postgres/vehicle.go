@@ -0,0 +1,142 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/lib/pq"
+	"time"
+)
+
+// VehicleCandidates returns other removed ads of the same manufacturer, model and year
+// seen since the given time and of the ads with given ids with their sellers, vehicles and photo hashes.
+// The ads still listed are other vehicles, e.g. of the same dealer, so they are not candidates.
+func (r *Repository) VehicleCandidates(ctx context.Context, car model.Car, since time.Time,
+	adIDs []string) ([]model.Car, error) {
+	q := r.psql.Builder().Select("c.ad_id", "c.manufacturer", "c.model", "c.year",
+		"c.mileage", "c.engine", "c.fuel", "c.automatic", "c.color", "c.price", "c.description", "c.posted",
+		"coalesce(s.link, '')", "coalesce(av.vehicle_id, 0)",
+		"(SELECT array_agg(h.phash ORDER BY h.position) FROM ad_photo_hashes h WHERE h.ad_id = c.ad_id)").
+		From("ads_current c").
+		LeftJoin("sellers s ON s.id = c.seller_id").
+		LeftJoin("ad_vehicles av ON av.ad_id = c.ad_id").
+		Where(sq.And{
+			sq.NotEq{"c.ad_id": car.AdID},
+			sq.Expr("EXISTS (SELECT 1 FROM removed_ads ra WHERE ra.ad_id = c.ad_id)"),
+			sq.Or{
+				sq.And{
+					sq.Eq{"c.manufacturer": car.Manufacturer, "c.model": car.Model, "c.year": car.Year},
+					sq.GtOrEq{"c.last_seen": since.Format(time.DateOnly)},
+				},
+				sq.Eq{"c.ad_id": adIDs},
+			},
+		})
+	rows, err := q.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cars := make([]model.Car, 0)
+	for rows.Next() {
+		var c model.Car
+		var photoHashes pq.Int64Array
+		if err = rows.Scan(&c.AdID, &c.Manufacturer, &c.Model, &c.Year, &c.Mileage, &c.EngineSize, &c.Fuel,
+			&c.AutomaticGearbox, &c.Color, &c.Price, &c.Description, &c.Posted, &c.Seller.Link,
+			&c.VehicleID, &photoHashes); err != nil {
+			return nil, err
+		}
+		for _, hash := range photoHashes {
+			c.PhotoHashes = append(c.PhotoHashes, uint64(hash))
+		}
+		cars = append(cars, c)
+	}
+	return cars, rows.Err()
+}
+
+// LinkVehicle links the ad to the vehicle of the matched ad and returns the vehicle id.
+// The vehicle is created if the matched ad has none or if matchAdID is empty.
+func (r *Repository) LinkVehicle(ctx context.Context, adID, matchAdID string, score float64) (int64, error) {
+	tx, err := r.psql.Tx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var vehicleID int64
+	if matchAdID != "" {
+		err = r.psql.Builder().Select("vehicle_id").From("ad_vehicles").
+			Where(sq.Eq{"ad_id": matchAdID}).
+			RunWith(tx).QueryRowContext(ctx).Scan(&vehicleID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+	}
+	if vehicleID == 0 {
+		err = r.psql.Builder().Insert("vehicles").Columns("created_at").Values(time.Now().UTC()).
+			Suffix("RETURNING id").
+			RunWith(tx).QueryRowContext(ctx).Scan(&vehicleID)
+		if err != nil {
+			return 0, err
+		}
+		if matchAdID != "" {
+			if err = r.linkVehicle(ctx, tx, matchAdID, vehicleID, 1); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err = r.linkVehicle(ctx, tx, adID, vehicleID, score); err != nil {
+		return 0, err
+	}
+	return vehicleID, tx.Commit()
+}
+
+func (r *Repository) linkVehicle(ctx context.Context, tx *sql.Tx, adID string, vehicleID int64,
+	score float64) error {
+	_, err := r.psql.Builder().Insert("ad_vehicles").Columns("ad_id", "vehicle_id", "score", "linked_at").
+		Values(adID, vehicleID, score, time.Now().UTC()).
+		Suffix("ON CONFLICT (ad_id) DO NOTHING").
+		RunWith(tx).ExecContext(ctx)
+	return err
+}
+
+// loadPreviousListings fills the earliest listing date and the last price of the other ads
+// of the same vehicle for reposted cars
+func (r *Repository) loadPreviousListings(ctx context.Context, cars []model.Car) error {
+	q := r.psql.Builder().Select("av.ad_id", "c.ad_id", "least(c.posted::date, c.first_seen)", "c.price").
+		From("ad_vehicles av").
+		Join("ad_vehicles o ON o.vehicle_id = av.vehicle_id AND o.ad_id <> av.ad_id").
+		Join("ads_current c ON c.ad_id = o.ad_id").
+		Where(sq.Eq{"av.ad_id": adIDs(cars)}).
+		OrderBy("c.last_seen")
+	rows, err := q.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	previous := make(map[string]model.PreviousListing)
+	for rows.Next() {
+		var adID, prevAdID string
+		var since time.Time
+		var price int
+		if err = rows.Scan(&adID, &prevAdID, &since, &price); err != nil {
+			return err
+		}
+		listing, ok := previous[adID]
+		if !ok || since.Before(listing.Since) {
+			listing.Since = since
+		}
+		// rows are ordered by the last seen date, so the last one has the last known price
+		listing.AdID = prevAdID
+		listing.Price = price
+		previous[adID] = listing
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i := range cars {
+		cars[i].Previous = previous[cars[i].AdID]
+	}
+	return nil
+}
@@ -3,18 +3,55 @@ package repository
 import (
 	"context"
 	"github.com/bopoh24/bazacars/internal/model"
+	"time"
 )
 
 type Repository interface {
-	SaveCars(ctx context.Context, car []model.Car) error
+	SaveCars(ctx context.Context, car []model.Car) ([]string, error)
+	LastSnapshots(ctx context.Context, adIDs []string) (map[string]model.Car, error)
+	MarkAdsSeen(ctx context.Context, adIDs []string) error
 	NewAds(ctx context.Context) ([]model.Car, error)
-	AdSent(ctx context.Context, adId string) error
-	UpdateSent(ctx context.Context) error
 	AdsWithNewPrice(ctx context.Context) ([]model.Car, error)
+	PriceNotified(ctx context.Context, adID string, price int, jobs []model.OutboxJob) error
+	PriceHistory(ctx context.Context, adID string) ([]model.PricePoint, error)
 	Users(ctx context.Context) ([]model.User, error)
 	User(ctx context.Context, chatID int64) (model.User, error)
 	Admins(ctx context.Context) ([]model.User, error)
 	UserAdd(ctx context.Context, user model.User) error
 	UserSave(ctx context.Context, user model.User) error
+	UserDeliverySave(ctx context.Context, chatID int64, mode model.DeliveryMode, digestHour int) error
+	CrawlRunCreate(ctx context.Context, run model.CrawlRun) (int64, error)
+	CrawlRunSave(ctx context.Context, run model.CrawlRun) error
+	CrawlRunUnfinished(ctx context.Context, mode model.CrawlMode, day time.Time) (model.CrawlRun, error)
+	CrawlRunLast(ctx context.Context, mode model.CrawlMode) (model.CrawlRun, error)
+	CrawlRunCompletedBefore(ctx context.Context, mode model.CrawlMode, runID int64) (model.CrawlRun, error)
+	CrawlRuns(ctx context.Context, limit int) ([]model.CrawlRun, error)
+	CrawlBrandSave(ctx context.Context, runID int64, brand model.CrawlBrand) error
+	MarkRemovedAds(ctx context.Context, seenSince, day time.Time) (int64, error)
+	RemovedAds(ctx context.Context) ([]model.RemovedAd, error)
+	RemovedAdNotified(ctx context.Context, adID string, jobs []model.OutboxJob) error
+	VehicleCandidates(ctx context.Context, car model.Car, since time.Time, adIDs []string) ([]model.Car, error)
+	LinkVehicle(ctx context.Context, adID, matchAdID string, score float64) (int64, error)
+	SavePhotoHashes(ctx context.Context, adID string, hashes []model.PhotoHash) error
+	SimilarPhotoAds(ctx context.Context, car model.Car, hashes []model.PhotoHash, maxDistance int) ([]string, error)
+	AdsWithoutPhotoHashes(ctx context.Context, afterAdID string, limit int) ([]model.Car, error)
+	ActiveSubscriptions(ctx context.Context) ([]model.Subscription, error)
+	Subscriptions(ctx context.Context, chatID int64) ([]model.Subscription, error)
+	Subscription(ctx context.Context, chatID, id int64) (model.Subscription, error)
+	SubscriptionSave(ctx context.Context, subscription model.Subscription) (int64, error)
+	SubscriptionDelete(ctx context.Context, chatID, id int64) error
+	Models(ctx context.Context, brands []string) ([]string, error)
+	Conversation(ctx context.Context, chatID int64) (model.Conversation, error)
+	ConversationSave(ctx context.Context, conversation model.Conversation) error
+	ConversationDelete(ctx context.Context, chatID int64) error
+	ConversationsExpire(ctx context.Context, before time.Time) (int64, error)
+	DeliveredChats(ctx context.Context, adIDs []string, events ...model.DeliveryEvent) (map[string][]int64, error)
+	AssumedChats(ctx context.Context, adIDs []string) (map[string][]int64, error)
+	OutboxEnqueue(ctx context.Context, jobs []model.OutboxJob) error
+	OutboxClaim(ctx context.Context, limit int, lease time.Duration) ([]model.OutboxJob, error)
+	OutboxSave(ctx context.Context, job model.OutboxJob) error
+	OutboxPurge(ctx context.Context, before time.Time) (int64, error)
+	OutboxHeld(ctx context.Context, chatIDs []int64) ([]model.OutboxJob, error)
+	OutboxBundle(ctx context.Context, digests []model.OutboxJob) error
 	Close(ctx context.Context) error
 }
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/parser"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrCrawlRunning = errors.New("another crawl is running")
+
+// Crawl parses ads of all brands in the given mode and records the run progress.
+// Today's unfinished full run is resumed from the last saved page of every brand, failed brands are retried.
+// Only one crawl runs at a time: fresh crawl is skipped while another crawl is running,
+// full crawl waits for the fresh one to finish.
+func (s *CarParsingService) Crawl(ctx context.Context, mode model.CrawlMode) (model.CrawlRun, error) {
+	if !s.startRunning(mode) {
+		return model.CrawlRun{}, ErrCrawlRunning
+	}
+	defer s.stopRunning(mode)
+	if mode == model.CrawlModeFresh {
+		if !s.crawlMu.TryLock() {
+			return model.CrawlRun{}, ErrCrawlRunning
+		}
+	} else {
+		s.crawlMu.Lock()
+	}
+	defer s.crawlMu.Unlock()
+
+	run, err := s.startRun(ctx, mode)
+	if err != nil {
+		return model.CrawlRun{}, err
+	}
+	if err = s.LoadCarBrands(ctx); err != nil {
+		return s.finishRun(ctx, run, fmt.Errorf("load car brands: %w", err))
+	}
+	brands := s.CarBrands()
+	for brand := range brands {
+		if _, ok := run.Brand(brand); ok {
+			continue
+		}
+		crawlBrand := model.CrawlBrand{Brand: brand, Status: model.CrawlStatusPending}
+		if err = s.repo.CrawlBrandSave(ctx, run.ID, crawlBrand); err != nil {
+			return s.finishRun(ctx, run, err)
+		}
+		run.Brands = append(run.Brands, crawlBrand)
+	}
+	sort.Slice(run.Brands, func(i, j int) bool {
+		return run.Brands[i].Brand < run.Brands[j].Brand
+	})
+
+	s.parseBrands(ctx, &run)
+	if ctx.Err() != nil {
+		// the run stays running to be resumed after restart
+		return run, ctx.Err()
+	}
+	run, err = s.finishRun(ctx, run, nil)
+	if err == nil && run.Mode == model.CrawlModeFull && run.Status == model.CrawlStatusCompleted {
+		s.markRemovedAds(ctx, run)
+	}
+	return run, err
+}
+
+// RunState returns the last crawl run of the mode with per-brand status
+func (s *CarParsingService) RunState(ctx context.Context, mode model.CrawlMode) (model.CrawlRun, error) {
+	return s.repo.CrawlRunLast(ctx, mode)
+}
+
+// HasUnfinishedRun reports whether today's run of the mode was interrupted and can be resumed
+func (s *CarParsingService) HasUnfinishedRun(ctx context.Context, mode model.CrawlMode) (bool, error) {
+	_, err := s.repo.CrawlRunUnfinished(ctx, mode, today())
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// startRun resumes today's unfinished full run or creates a new one
+func (s *CarParsingService) startRun(ctx context.Context, mode model.CrawlMode) (model.CrawlRun, error) {
+	if mode == model.CrawlModeFull {
+		run, err := s.repo.CrawlRunUnfinished(ctx, mode, today())
+		if err == nil {
+			s.log.Info("Resuming crawl run", "run_id", run.ID, "started_at", run.StartedAt)
+			return run, nil
+		}
+		if !errors.Is(err, repository.ErrNotFound) {
+			return model.CrawlRun{}, err
+		}
+	}
+	run := model.CrawlRun{
+		Mode:      mode,
+		Day:       today(),
+		Status:    model.CrawlStatusRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	id, err := s.repo.CrawlRunCreate(ctx, run)
+	if err != nil {
+		return model.CrawlRun{}, err
+	}
+	run.ID = id
+	return run, nil
+}
+
+// finishRun marks the run completed, or failed if there is an error or any brand failed
+func (s *CarParsingService) finishRun(ctx context.Context, run model.CrawlRun, err error) (model.CrawlRun, error) {
+	run.Status = model.CrawlStatusCompleted
+	run.FinishedAt = time.Now().UTC()
+	if err != nil {
+		run.Status = model.CrawlStatusFailed
+		run.Error = err.Error()
+	}
+	for _, brand := range run.Brands {
+		if brand.Status == model.CrawlStatusFailed {
+			run.Status = model.CrawlStatusFailed
+		}
+	}
+	if saveErr := s.repo.CrawlRunSave(ctx, run); saveErr != nil {
+		return run, errors.Join(err, saveErr)
+	}
+	return run, err
+}
+
+// parseBrands parses not completed brands of the run, brandWorkers brands at a time.
+// The brands failed before the run was interrupted are retried from their last saved page.
+func (s *CarParsingService) parseBrands(ctx context.Context, run *model.CrawlRun) {
+	parseBrand := s.ParseAdsByBrand
+	if run.Mode == model.CrawlModeFresh {
+		parseBrand = s.ParseFreshAdsByBrand
+	}
+	sem := make(chan struct{}, s.brandWorkers)
+	var wg sync.WaitGroup
+	for i := range run.Brands {
+		brand := &run.Brands[i]
+		if brand.Status == model.CrawlStatusCompleted {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			brand.Status = model.CrawlStatusRunning
+			brand.Error = ""
+			s.saveBrand(ctx, run.ID, *brand)
+
+			// duration, request and 403 counts are added to the ones of the interrupted attempt
+			started, duration, requests, forbidden := time.Now(), brand.Duration, brand.Requests, brand.Forbidden
+			fetchStats := &parser.FetchStats{}
+			updateStats := func() {
+				brand.Duration = duration + time.Since(started)
+				brand.Requests = requests + int(fetchStats.Requests.Load())
+				brand.Forbidden = forbidden + int(fetchStats.Forbidden.Load())
+			}
+			err := parseBrand(parser.WithFetchStats(ctx, fetchStats), brand.Brand, brand.LastPage+1,
+				func(page, pages int, stats model.CrawlStats) {
+					brand.LastPage = page
+					brand.TotalPages = pages
+					brand.Add(stats)
+					updateStats()
+					s.saveBrand(ctx, run.ID, *brand)
+				})
+			if ctx.Err() != nil {
+				return
+			}
+			updateStats()
+			brand.Status = model.CrawlStatusCompleted
+			if err != nil {
+				s.log.Error("Failed to parse ads by brand", "brand", brand.Brand, "mode", run.Mode, "err", err)
+				brand.Status = model.CrawlStatusFailed
+				brand.Error = err.Error()
+			}
+			s.saveBrand(ctx, run.ID, *brand)
+		}()
+	}
+	wg.Wait()
+}
+
+// markRemovedAds marks the ads seen by the previous complete full crawl but missing in the run as removed.
+// Only complete runs are compared, otherwise the ads of the failed brands would be taken for removed.
+func (s *CarParsingService) markRemovedAds(ctx context.Context, run model.CrawlRun) {
+	prev, err := s.repo.CrawlRunCompletedBefore(ctx, run.Mode, run.ID)
+	if errors.Is(err, repository.ErrNotFound) {
+		s.log.Info("No previous complete crawl run to detect removed ads", "run_id", run.ID)
+		return
+	}
+	if err != nil {
+		s.log.Error("Failed to get previous crawl run", "run_id", run.ID, "err", err)
+		return
+	}
+	removed, err := s.repo.MarkRemovedAds(ctx, prev.Day, run.Day)
+	if err != nil {
+		s.log.Error("Failed to mark removed ads", "run_id", run.ID, "err", err)
+		return
+	}
+	s.log.Info("Removed ads marked", "run_id", run.ID, "previous_run_id", prev.ID, "removed", removed)
+}
+
+func (s *CarParsingService) saveBrand(ctx context.Context, runID int64, brand model.CrawlBrand) {
+	if err := s.repo.CrawlBrandSave(ctx, runID, brand); err != nil {
+		s.log.Error("Failed to save brand progress", "brand", brand.Brand, "run_id", runID, "err", err)
+	}
+}
+
+func (s *CarParsingService) startRunning(mode model.CrawlMode) bool {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	if s.running[mode] {
+		return false
+	}
+	s.running[mode] = true
+	return true
+}
+
+func (s *CarParsingService) stopRunning(mode model.CrawlMode) {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	delete(s.running, mode)
+}
+
+func today() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -4,123 +4,401 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/bopoh24/bazacars/internal/config"
 	"github.com/bopoh24/bazacars/internal/model"
 	"github.com/bopoh24/bazacars/internal/parser"
 	"github.com/bopoh24/bazacars/internal/repository"
 	"log/slog"
-	"math/rand"
 	"net/url"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 )
 
-const carUrl = "/car-motorbikes-boats-and-parts/cars-trucks-and-vans/"
+const (
+	carUrl = "/car-motorbikes-boats-and-parts/cars-trucks-and-vans/"
+
+	orderingNewest = "newest"
+)
 
 type CarParsingService struct {
-	targetSite  string
-	brands      map[string]string
-	repo        repository.Repository
-	parsingDate time.Time
-	log         *slog.Logger
+	targetSite     string
+	adWorkers      int
+	brandWorkers   int
+	freshStopAfter int
+	freshMaxPages  int
+	photoHashCount int
+	photoMaxBytes  int64
+	parser         *parser.Parser
+	brandsMu       sync.RWMutex
+	brands         map[string]string
+	repo           repository.Repository
+	parsingDate    time.Time
+	log            *slog.Logger
+	crawlMu        sync.Mutex
+	runningMu      sync.Mutex
+	running        map[model.CrawlMode]bool
 }
 
 // NewCarParsingService creates a new car parsing service
-func NewCarParsingService(targetSite string, repo repository.Repository, log *slog.Logger) *CarParsingService {
+func NewCarParsingService(targetSite string, conf config.Parser, p *parser.Parser, repo repository.Repository,
+	log *slog.Logger) *CarParsingService {
 	log = log.With(slog.String("service", "car_parsing"))
 	return &CarParsingService{
-		targetSite: targetSite,
-		repo:       repo,
-		log:        log,
+		targetSite:     targetSite,
+		adWorkers:      max(conf.AdWorkers, 1),
+		brandWorkers:   max(conf.BrandWorkers, 1),
+		freshStopAfter: max(conf.FreshStopAfter, 1),
+		freshMaxPages:  max(conf.FreshMaxPages, 1),
+		photoHashCount: conf.PhotoHashCount,
+		photoMaxBytes:  conf.PhotoMaxBytes,
+		parser:         p,
+		repo:           repo,
+		log:            log,
+		running:        make(map[model.CrawlMode]bool),
 	}
 }
 
 // LoadCarBrands loads car brands from the target site
-func (s *CarParsingService) LoadCarBrands() (err error) {
+func (s *CarParsingService) LoadCarBrands(ctx context.Context) error {
 	s.log.Info("Loading car brands", "url", s.targetSite+carUrl)
-	s.brands, err = parser.ParseCarBrands(s.targetSite + carUrl)
-	return err
+	brands, err := s.parser.ParseCarBrands(ctx, s.targetSite+carUrl)
+	if err != nil {
+		return err
+	}
+	s.brandsMu.Lock()
+	defer s.brandsMu.Unlock()
+	s.brands = brands
+	return nil
 }
 
 // CarBrands returns the list of car brands
 func (s *CarParsingService) CarBrands() map[string]string {
-	return s.brands
+	s.brandsMu.RLock()
+	defer s.brandsMu.RUnlock()
+	result := make(map[string]string, len(s.brands))
+	for brand, link := range s.brands {
+		result[brand] = link
+	}
+	return result
 }
 
-// ParseAdsByBrand parses ads by brand
-func (s *CarParsingService) ParseAdsByBrand(ctx context.Context, brand string) error {
+// brandPage returns the listing URL of the brand
+func (s *CarParsingService) brandPage(brand string) (string, error) {
+	s.brandsMu.RLock()
 	brandLink, ok := s.brands[brand]
+	s.brandsMu.RUnlock()
 	if !ok {
-		return fmt.Errorf("brand %q not found", brand)
+		return "", fmt.Errorf("brand %q not found", brand)
 	}
-	brandPage, err := url.JoinPath(s.targetSite, brandLink)
+	return url.JoinPath(s.targetSite, brandLink)
+}
+
+// listPage returns the URL of the listing page with optional ordering
+func listPage(brandPage string, page int, ordering string) (string, error) {
+	pageUrl, err := url.Parse(brandPage)
 	if err != nil {
-		return err
+		return "", err
+	}
+	query := pageUrl.Query()
+	query.Set("page", strconv.Itoa(page))
+	if ordering != "" {
+		query.Set("ordering", ordering)
 	}
-	brandUrl, err := url.Parse(brandPage)
+	pageUrl.RawQuery = query.Encode()
+	return pageUrl.String(), nil
+}
+
+// pageProgress is called after each saved listing page of the brand with the stats of the page
+type pageProgress func(page, pages int, stats model.CrawlStats)
+
+// ParseAdsByBrand parses ads by brand starting from the page fromPage
+func (s *CarParsingService) ParseAdsByBrand(ctx context.Context, brand string, fromPage int,
+	progress pageProgress) error {
+	brandPage, err := s.brandPage(brand)
 	if err != nil {
 		return err
 	}
-	pages, err := parser.TotalPages(brandPage)
+	pages, err := s.parser.TotalPages(ctx, brandPage)
 	if err != nil {
 		return err
 	}
 
-	s.log.Info("Total pages", "manufacturer", brand, "pages", pages)
+	s.log.Info("Total pages", "manufacturer", brand, "pages", pages, "from", fromPage,
+		"rate", s.parser.Rate(brandPage))
 
-	for i := 1; i <= pages; i++ {
-		brandPageUrl := new(url.URL)
-		*brandPageUrl = *brandUrl
-		query := brandPageUrl.Query()
-		query.Add("page", strconv.Itoa(i))
-		brandPageUrl.RawQuery = query.Encode()
+	for i := max(fromPage, 1); i <= pages; i++ {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
-		s.log.Info("Parsing", "manufacturer", brand, "link", brandPageUrl.String())
-		adLinks, err := parser.ParseAdList(brandPageUrl.String())
+		pageUrl, err := listPage(brandPage, i, "")
 		if err != nil {
 			return err
 		}
-		pageAds := make([]model.Car, 0, len(adLinks))
-		for _, adLink := range adLinks {
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
-			for {
-				car, err := parser.ParseCarPage(s.targetSite + adLink)
-				if err != nil {
-					if errors.Is(err, parser.ErrStatusForbidden) {
-						time.Sleep(time.Second + time.Duration(rand.Intn(2500))*time.Millisecond)
-						continue
-					}
-					s.log.Error("Parsing error", "error", err, "link", adLink)
+		s.log.Info("Parsing", "manufacturer", brand, "link", pageUrl)
+		adSummaries, err := s.parser.ParseAdList(ctx, pageUrl)
+		if err != nil {
+			return err
+		}
+		snapshots, err := s.lastSnapshots(ctx, adSummaries)
+		if err != nil {
+			return err
+		}
+		changed, unchanged := splitUnchanged(adSummaries, snapshots)
+		pageAds, failed := s.parseAds(ctx, changed)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		changedAds, err := s.repo.SaveCars(ctx, pageAds)
+		if err != nil {
+			return err
+		}
+		// the ads which failed to fetch are still listed and must not be detected as removed
+		if err := s.repo.MarkAdsSeen(ctx, append(unchanged, failed...)); err != nil {
+			return err
+		}
+		s.linkVehicles(ctx, newAds(pageAds, snapshots))
+		s.log.Info("Saved", "brand", brand, "page", i, "fetched", len(pageAds), "unchanged", len(unchanged),
+			"rate", s.parser.Rate(brandPage))
+		stats := pageStats(pageAds, len(changed), snapshots, changedAds)
+		stats.Unchanged += len(unchanged)
+		progress(i, pages, stats)
+	}
+	return nil
+}
+
+// ParseFreshAdsByBrand parses the newest ads of the brand. It stops paging once freshStopAfter
+// consecutive ads are already stored with unchanged price. Fresh crawl always starts from the first page.
+func (s *CarParsingService) ParseFreshAdsByBrand(ctx context.Context, brand string, _ int,
+	progress pageProgress) error {
+	brandPage, err := s.brandPage(brand)
+	if err != nil {
+		return err
+	}
+	known := 0
+	for i := 1; i <= s.freshMaxPages; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		pageUrl, err := listPage(brandPage, i, orderingNewest)
+		if err != nil {
+			return err
+		}
+		adSummaries, err := s.parser.ParseAdList(ctx, pageUrl)
+		if err != nil {
+			return err
+		}
+		if len(adSummaries) == 0 {
+			return nil
+		}
+		snapshots, err := s.lastSnapshots(ctx, adSummaries)
+		if err != nil {
+			return err
+		}
+		fresh := make([]model.AdSummary, 0, len(adSummaries))
+		stop := false
+		for _, adSummary := range adSummaries {
+			snapshot, ok := snapshots[adSummary.AdID]
+			if ok && snapshot.Price == adSummary.Price {
+				known++
+				if known >= s.freshStopAfter {
+					stop = true
 					break
 				}
-				pageAds = append(pageAds, car)
-				break
+				continue
 			}
+			known = 0
+			fresh = append(fresh, adSummary)
+		}
+		pageAds, failed := s.parseAds(ctx, fresh)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		changedAds, err := s.repo.SaveCars(ctx, pageAds)
+		if err != nil {
+			return err
 		}
-		if err := s.repo.SaveCars(ctx, pageAds); err != nil {
+		if err := s.repo.MarkAdsSeen(ctx, failed); err != nil {
 			return err
 		}
-		s.log.Info("Saved", "brand", brand, "page", i)
+		s.linkVehicles(ctx, newAds(pageAds, snapshots))
+		s.log.Info("Fresh ads saved", "brand", brand, "page", i, "fetched", len(pageAds))
+		progress(i, s.freshMaxPages, pageStats(pageAds, len(fresh), snapshots, changedAds))
+		if stop {
+			return nil
+		}
 	}
 	return nil
 }
 
+// lastSnapshots returns the last stored snapshots of the list page ads by ad id
+func (s *CarParsingService) lastSnapshots(ctx context.Context,
+	adSummaries []model.AdSummary) (map[string]model.Car, error) {
+	adIDs := make([]string, 0, len(adSummaries))
+	for _, adSummary := range adSummaries {
+		if adSummary.AdID != "" {
+			adIDs = append(adIDs, adSummary.AdID)
+		}
+	}
+	return s.repo.LastSnapshots(ctx, adIDs)
+}
+
+// splitUnchanged splits the list page ads into the ones which need to be fetched
+// and ids of the ads which list price and date match the last stored snapshot
+func splitUnchanged(adSummaries []model.AdSummary,
+	snapshots map[string]model.Car) ([]model.AdSummary, []string) {
+	changed := make([]model.AdSummary, 0, len(adSummaries))
+	var unchanged []string
+	for _, adSummary := range adSummaries {
+		snapshot, ok := snapshots[adSummary.AdID]
+		if ok && isUnchanged(adSummary, snapshot) {
+			unchanged = append(unchanged, adSummary.AdID)
+			continue
+		}
+		changed = append(changed, adSummary)
+	}
+	return changed, unchanged
+}
+
+// pageStats counts the parsed ads of the page as new or updated by the stored snapshots. The stored ads
+// are updated only if their snapshot changed, the other ones are unchanged.
+// The ads requested but not parsed are counted as failed.
+func pageStats(pageAds []model.Car, requested int, snapshots map[string]model.Car,
+	changed []string) model.CrawlStats {
+	stats := model.CrawlStats{
+		Pages:  1,
+		Parsed: len(pageAds),
+		Failed: requested - len(pageAds),
+	}
+	for _, car := range pageAds {
+		_, stored := snapshots[car.AdID]
+		switch {
+		case !stored:
+			stats.New++
+		case slices.Contains(changed, car.AdID):
+			stats.Updated++
+		default:
+			stats.Unchanged++
+		}
+	}
+	return stats
+}
+
+// isUnchanged reports whether the list page ad has the same price and posting date as the snapshot
+func isUnchanged(adSummary model.AdSummary, snapshot model.Car) bool {
+	if adSummary.Price == 0 || adSummary.Posted.IsZero() {
+		return false
+	}
+	return adSummary.Price == snapshot.Price &&
+		adSummary.Posted.Format(time.DateOnly) == snapshot.Posted.Format(time.DateOnly)
+}
+
+// parseAds fetches the ad pages, adWorkers pages at a time, the order of the ads is kept.
+// The ads which failed to parse are skipped and their ids are returned as failed.
+func (s *CarParsingService) parseAds(ctx context.Context, adSummaries []model.AdSummary) ([]model.Car, []string) {
+	cars := make([]model.Car, len(adSummaries))
+	parsed := make([]bool, len(adSummaries))
+	sem := make(chan struct{}, s.adWorkers)
+	var wg sync.WaitGroup
+	for i, adSummary := range adSummaries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, nil
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			car, err := s.parser.ParseCarPage(ctx, s.targetSite+adSummary.Link)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.log.Error("Parsing error", "error", err, "link", adSummary.Link,
+						"forbidden", errors.Is(err, parser.ErrStatusForbidden))
+				}
+				return
+			}
+			if car.Seller.Name == "" {
+				car.Seller = adSummary.Seller
+			}
+			cars[i] = car
+			parsed[i] = true
+		}()
+	}
+	wg.Wait()
+
+	result := make([]model.Car, 0, len(cars))
+	var failed []string
+	for i, car := range cars {
+		if parsed[i] {
+			result = append(result, car)
+		} else if adSummaries[i].AdID != "" {
+			failed = append(failed, adSummaries[i].AdID)
+		}
+	}
+	return result, failed
+}
+
+// LogProxyStats logs the usage statistics of outbound proxies
+func (s *CarParsingService) LogProxyStats() {
+	for _, stats := range s.parser.ProxyStats() {
+		s.log.Info("Proxy stats", "proxy", stats.Proxy, "requests", stats.Requests,
+			"successes", stats.Successes, "failures", stats.Failures, "blocked", stats.Blocked,
+			"benched", stats.Benched, "benched_until", stats.BenchedUntil)
+	}
+}
+
 // NewAds returns new ads
 func (s *CarParsingService) NewAds(ctx context.Context) ([]model.Car, error) {
 	return s.repo.NewAds(ctx)
 }
 
-// AdSent marks the ad as sent
-func (s *CarParsingService) AdSent(ctx context.Context, adId string) error {
-	return s.repo.AdSent(ctx, adId)
+// OutboxEnqueue adds the notifications to the outbox
+func (s *CarParsingService) OutboxEnqueue(ctx context.Context, jobs []model.OutboxJob) error {
+	return s.repo.OutboxEnqueue(ctx, jobs)
+}
+
+// OutboxClaim returns the pending notifications due to be sent and postpones them for the lease time
+func (s *CarParsingService) OutboxClaim(ctx context.Context, limit int, lease time.Duration) ([]model.OutboxJob, error) {
+	return s.repo.OutboxClaim(ctx, limit, lease)
+}
+
+// OutboxSave saves the state of the claimed notification
+func (s *CarParsingService) OutboxSave(ctx context.Context, job model.OutboxJob) error {
+	return s.repo.OutboxSave(ctx, job)
 }
 
-// UpdateSent updates the sent field in the database
-func (s *CarParsingService) UpdateSent(ctx context.Context) error {
-	return s.repo.UpdateSent(ctx)
+// OutboxPurge deletes the notifications sent before the time and returns their number
+func (s *CarParsingService) OutboxPurge(ctx context.Context, before time.Time) (int64, error) {
+	return s.repo.OutboxPurge(ctx, before)
+}
+
+// OutboxHeld returns the notifications held for the digests of the chats
+func (s *CarParsingService) OutboxHeld(ctx context.Context, chatIDs []int64) ([]model.OutboxJob, error) {
+	return s.repo.OutboxHeld(ctx, chatIDs)
+}
+
+// OutboxBundle enqueues the digests of the held notifications
+func (s *CarParsingService) OutboxBundle(ctx context.Context, digests []model.OutboxJob) error {
+	return s.repo.OutboxBundle(ctx, digests)
+}
+
+// Users returns all users
+func (s *CarParsingService) Users(ctx context.Context) ([]model.User, error) {
+	return s.repo.Users(ctx)
+}
+
+// DeliveredChats returns the chats the ads are successfully delivered to by ad id
+func (s *CarParsingService) DeliveredChats(ctx context.Context, adIDs []string,
+	events ...model.DeliveryEvent) (map[string][]int64, error) {
+	return s.repo.DeliveredChats(ctx, adIDs, events...)
+}
+
+// AssumedChats returns the chats the ads sent before the deliveries were tracked are assumed to be delivered to
+func (s *CarParsingService) AssumedChats(ctx context.Context, adIDs []string) (map[string][]int64, error) {
+	return s.repo.AssumedChats(ctx, adIDs)
 }
 
 // AdsWithNewPrice returns ads with new price
@@ -128,6 +406,32 @@ func (s *CarParsingService) AdsWithNewPrice(ctx context.Context) ([]model.Car, e
 	return s.repo.AdsWithNewPrice(ctx)
 }
 
+// PriceNotified records the price subscribers are notified about and enqueues the notifications
+func (s *CarParsingService) PriceNotified(ctx context.Context, adID string, price int,
+	jobs []model.OutboxJob) error {
+	return s.repo.PriceNotified(ctx, adID, price, jobs)
+}
+
+// PriceHistory returns the price changes of the ad
+func (s *CarParsingService) PriceHistory(ctx context.Context, adID string) ([]model.PricePoint, error) {
+	return s.repo.PriceHistory(ctx, adID)
+}
+
+// ActiveSubscriptions returns the subscriptions of approved users
+func (s *CarParsingService) ActiveSubscriptions(ctx context.Context) ([]model.Subscription, error) {
+	return s.repo.ActiveSubscriptions(ctx)
+}
+
+// RemovedAds returns the removed ads which subscribers are not notified about
+func (s *CarParsingService) RemovedAds(ctx context.Context) ([]model.RemovedAd, error) {
+	return s.repo.RemovedAds(ctx)
+}
+
+// RemovedAdNotified marks subscribers notified about the removed ad and enqueues the notifications
+func (s *CarParsingService) RemovedAdNotified(ctx context.Context, adID string, jobs []model.OutboxJob) error {
+	return s.repo.RemovedAdNotified(ctx, adID, jobs)
+}
+
 // Close closes the car parsing service
 func (s *CarParsingService) Close(ctx context.Context) {
 	s.log.Info("closing car parsing service")
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/bopoh24/bazacars/internal/config"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/parser"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSite = "https://example.com"
+
+// pageFetcher serves the brand page with a single listing page and the sample ad list,
+// the ad pages are forbidden. The fetched URLs are sent to fetched if it is set,
+// blocking fetches wait for the context to be done.
+type pageFetcher struct {
+	fetched  chan<- string
+	blocking bool
+}
+
+func (f pageFetcher) Fetch(ctx context.Context, url string) (io.ReadCloser, error) {
+	if f.fetched != nil {
+		f.fetched <- url
+	}
+	if f.blocking {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	switch {
+	case strings.Contains(url, "page="):
+		return os.Open("../parser/testing/main.sample")
+	case url == testSite+"/audi/":
+		return io.NopCloser(strings.NewReader("<html></html>")), nil
+	}
+	return nil, fmt.Errorf("%s: %w", url, parser.ErrStatusForbidden)
+}
+
+// seenRepo stores the saved ads and the ads marked as seen.
+// The listed ads are known with the price of snapshots or with another price if snapshots is nil.
+type seenRepo struct {
+	repository.Repository
+	mu        sync.Mutex
+	snapshots map[string]model.Car
+	pages     int
+	saved     []model.Car
+	seen      []string
+}
+
+func (r *seenRepo) LastSnapshots(_ context.Context, adIDs []string) (map[string]model.Car, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pages++
+	if r.snapshots != nil {
+		return r.snapshots, nil
+	}
+	snapshots := make(map[string]model.Car, len(adIDs))
+	for _, adID := range adIDs {
+		snapshots[adID] = model.Car{AdID: adID, Price: 1}
+	}
+	return snapshots, nil
+}
+
+func (r *seenRepo) SaveCars(_ context.Context, cars []model.Car) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.saved = append(r.saved, cars...)
+	return nil, nil
+}
+
+func (r *seenRepo) MarkAdsSeen(_ context.Context, adIDs []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = append(r.seen, adIDs...)
+	return nil
+}
+
+func (r *seenRepo) CrawlBrandSave(context.Context, int64, model.CrawlBrand) error {
+	return nil
+}
+
+func (r *seenRepo) CrawlRunUnfinished(context.Context, model.CrawlMode, time.Time) (model.CrawlRun, error) {
+	return model.CrawlRun{}, repository.ErrNotFound
+}
+
+func (r *seenRepo) CrawlRunCreate(context.Context, model.CrawlRun) (int64, error) {
+	return 1, nil
+}
+
+func (r *seenRepo) CrawlRunSave(context.Context, model.CrawlRun) error {
+	return nil
+}
+
+func newTestService(fetcher parser.Fetcher, repo repository.Repository, conf config.Parser) *CarParsingService {
+	conf.AdWorkers = 4
+	return NewCarParsingService(testSite, conf, parser.New(fetcher), repo,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestParseAdsByBrandMarksFailedAdsSeen(t *testing.T) {
+	repo := &seenRepo{}
+	s := newTestService(pageFetcher{}, repo, config.Parser{})
+	s.brands = map[string]string{"Audi": "/audi/"}
+
+	listed, err := parser.New(pageFetcher{}).ParseAdList(context.Background(), testSite+"/audi/?page=1")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, listed)
+
+	var stats model.CrawlStats
+	err = s.ParseAdsByBrand(context.Background(), "Audi", 1, func(_, _ int, page model.CrawlStats) {
+		stats = page
+	})
+	assert.NoError(t, err)
+
+	assert.Empty(t, repo.saved)
+	assert.Equal(t, len(listed), stats.Failed)
+	assert.Len(t, repo.seen, len(listed))
+	for _, adSummary := range listed {
+		assert.Contains(t, repo.seen, adSummary.AdID)
+	}
+}
+
+func TestParseFreshAdsByBrandStopsAtKnownAds(t *testing.T) {
+	listed, err := parser.New(pageFetcher{}).ParseAdList(context.Background(), testSite+"/audi/?page=1")
+	assert.NoError(t, err)
+	assert.Greater(t, len(listed), 4)
+
+	// the first two ads are new, the rest are known with the same price
+	snapshots := make(map[string]model.Car)
+	for _, adSummary := range listed[2:] {
+		snapshots[adSummary.AdID] = model.Car{AdID: adSummary.AdID, Price: adSummary.Price}
+	}
+	repo := &seenRepo{snapshots: snapshots}
+	s := newTestService(pageFetcher{}, repo, config.Parser{FreshStopAfter: 2, FreshMaxPages: 5})
+	s.brands = map[string]string{"Audi": "/audi/"}
+
+	var stats model.CrawlStats
+	err = s.ParseFreshAdsByBrand(context.Background(), "Audi", 0, func(_, _ int, page model.CrawlStats) {
+		stats.Add(page)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, repo.pages)
+	assert.Equal(t, 1, stats.Pages)
+	assert.Equal(t, 2, stats.Failed)
+	assert.ElementsMatch(t, []string{listed[0].AdID, listed[1].AdID}, repo.seen)
+}
+
+func TestCrawlSkipsFreshWhileFullIsRunning(t *testing.T) {
+	fetched := make(chan string, 10)
+	s := newTestService(pageFetcher{fetched: fetched, blocking: true}, &seenRepo{}, config.Parser{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := s.Crawl(ctx, model.CrawlModeFull)
+		done <- err
+	}()
+	<-fetched
+
+	_, err := s.Crawl(context.Background(), model.CrawlModeFresh)
+	assert.ErrorIs(t, err, ErrCrawlRunning)
+	_, err = s.Crawl(context.Background(), model.CrawlModeFull)
+	assert.ErrorIs(t, err, ErrCrawlRunning)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestCrawlFullWaitsForFresh(t *testing.T) {
+	fetched := make(chan string, 10)
+	s := newTestService(pageFetcher{fetched: fetched, blocking: true}, &seenRepo{}, config.Parser{})
+
+	freshCtx, cancelFresh := context.WithCancel(context.Background())
+	freshDone := make(chan error)
+	go func() {
+		_, err := s.Crawl(freshCtx, model.CrawlModeFresh)
+		freshDone <- err
+	}()
+	<-fetched
+
+	fullCtx, cancelFull := context.WithCancel(context.Background())
+	defer cancelFull()
+	fullDone := make(chan error)
+	go func() {
+		_, err := s.Crawl(fullCtx, model.CrawlModeFull)
+		fullDone <- err
+	}()
+	select {
+	case <-fetched:
+		t.Fatal("full crawl started while fresh crawl is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelFresh()
+	assert.ErrorIs(t, <-freshDone, context.Canceled)
+	select {
+	case <-fetched:
+	case <-time.After(time.Second):
+		t.Fatal("full crawl did not start after fresh crawl finished")
+	}
+	cancelFull()
+	assert.ErrorIs(t, <-fullDone, context.Canceled)
+}
+
+func TestParseBrandsRetriesFailedBrands(t *testing.T) {
+	s := newTestService(pageFetcher{}, &seenRepo{}, config.Parser{})
+	s.brands = map[string]string{"Audi": "/audi/", "BMW": "/bmw/"}
+
+	// the run was interrupted after Audi had failed and BMW had completed
+	run := model.CrawlRun{ID: 1, Mode: model.CrawlModeFull, Brands: []model.CrawlBrand{
+		{Brand: "Audi", Status: model.CrawlStatusFailed, Error: "forbidden"},
+		{Brand: "BMW", Status: model.CrawlStatusCompleted, LastPage: 3, TotalPages: 3},
+	}}
+	s.parseBrands(context.Background(), &run)
+
+	audi, _ := run.Brand("Audi")
+	assert.Equal(t, model.CrawlStatusCompleted, audi.Status)
+	assert.Empty(t, audi.Error)
+	assert.Equal(t, 1, audi.LastPage)
+	bmw, _ := run.Brand("BMW")
+	assert.Equal(t, 3, bmw.LastPage)
+	assert.Zero(t, bmw.Pages)
+}
+
+func TestPageStats(t *testing.T) {
+	pageAds := []model.Car{{AdID: "1"}, {AdID: "2", Price: 900}, {AdID: "3", Price: 1000}}
+	snapshots := map[string]model.Car{"2": {AdID: "2", Price: 1000}, "3": {AdID: "3", Price: 1000}}
+	// ad 2 got a new snapshot, ad 3 is fetched again but nothing changed
+	stats := pageStats(pageAds, 4, snapshots, []string{"1", "2"})
+	assert.Equal(t, model.CrawlStats{Pages: 1, Parsed: 3, New: 1, Updated: 1, Unchanged: 1, Failed: 1}, stats)
+}
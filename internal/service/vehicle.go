@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"github.com/bopoh24/bazacars/internal/fingerprint"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/pkg/imagehash"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// repostLookback is how long ago the ad may have been seen to be matched with a new ad
+	repostLookback = 180 * 24 * time.Hour
+	// photoHashBackfillBatch is the number of the ads hashed by the backfill at a time
+	photoHashBackfillBatch = 100
+)
+
+// linkVehicles links the new ads to the vehicles of the most similar earlier ads,
+// the ads without a similar one get a vehicle of their own
+func (s *CarParsingService) linkVehicles(ctx context.Context, cars []model.Car) {
+	photoHashes := s.hashPhotos(ctx, cars)
+	since := time.Now().Add(-repostLookback)
+	for i, car := range cars {
+		// ads with the same photos are matched even if they are older than the lookback
+		samePhotos, err := s.repo.SimilarPhotoAds(ctx, car, photoHashes[i], fingerprint.MaxPhotoDistance)
+		if err != nil {
+			s.log.Error("Failed to get ads with similar photos", "ad_id", car.AdID, "err", err)
+			continue
+		}
+		candidates, err := s.repo.VehicleCandidates(ctx, car, since, samePhotos)
+		if err != nil {
+			s.log.Error("Failed to get vehicle candidates", "ad_id", car.AdID, "err", err)
+			continue
+		}
+		match, ok := fingerprint.BestMatch(car, candidates)
+		if !ok {
+			match = fingerprint.Match{}
+		}
+		vehicleID, err := s.repo.LinkVehicle(ctx, car.AdID, match.Car.AdID, match.Score)
+		if err != nil {
+			s.log.Error("Failed to link vehicle", "ad_id", car.AdID, "err", err)
+			continue
+		}
+		if ok {
+			s.log.Info("Repost detected", "ad_id", car.AdID, "previous_ad_id", match.Car.AdID,
+				"vehicle_id", vehicleID, "score", match.Score)
+		}
+	}
+}
+
+// BackfillPhotoHashes hashes the photos of the ads stored without photo hashes, e.g. before the photos
+// were hashed, so the reposts of these ads are matched by photos. It returns the number of the ads processed.
+// The ads which photos failed are retried by the next backfill.
+func (s *CarParsingService) BackfillPhotoHashes(ctx context.Context) (int, error) {
+	if s.photoHashCount <= 0 {
+		return 0, nil
+	}
+	processed, after := 0, ""
+	for {
+		cars, err := s.repo.AdsWithoutPhotoHashes(ctx, after, photoHashBackfillBatch)
+		if err != nil {
+			return processed, err
+		}
+		if len(cars) == 0 {
+			return processed, nil
+		}
+		s.hashPhotos(ctx, cars)
+		if ctx.Err() != nil {
+			return processed, ctx.Err()
+		}
+		processed += len(cars)
+		after = cars[len(cars)-1].AdID
+	}
+}
+
+// hashPhotos downloads the first photos of the cars, adWorkers cars at a time, stores and returns
+// their hashes in the order of the cars. The perceptual hashes are set to PhotoHashes of the cars,
+// the photos which failed are skipped.
+func (s *CarParsingService) hashPhotos(ctx context.Context, cars []model.Car) [][]model.PhotoHash {
+	photoHashes := make([][]model.PhotoHash, len(cars))
+	if s.photoHashCount <= 0 {
+		return photoHashes
+	}
+	sem := make(chan struct{}, s.adWorkers)
+	var wg sync.WaitGroup
+	for i := range cars {
+		car := &cars[i]
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return photoHashes
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			hashes := make([]model.PhotoHash, 0, s.photoHashCount)
+			for position, photo := range car.Photos[:min(len(car.Photos), s.photoHashCount)] {
+				hash, err := s.hashPhoto(ctx, photo)
+				if err != nil {
+					if ctx.Err() == nil {
+						s.log.Warn("Failed to hash photo", "ad_id", car.AdID, "photo", photo, "err", err)
+					}
+					continue
+				}
+				hash.Position = position
+				hashes = append(hashes, hash)
+				car.PhotoHashes = append(car.PhotoHashes, hash.PHash)
+			}
+			photoHashes[i] = hashes
+			if err := s.repo.SavePhotoHashes(ctx, car.AdID, hashes); err != nil {
+				s.log.Error("Failed to save photo hashes", "ad_id", car.AdID, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return photoHashes
+}
+
+// hashPhoto downloads the photo and returns its hashes
+func (s *CarParsingService) hashPhoto(ctx context.Context, photo string) (model.PhotoHash, error) {
+	photoUrl := photo
+	if strings.HasPrefix(photoUrl, "/") {
+		photoUrl = s.targetSite + photoUrl
+	}
+	data, err := s.parser.FetchPhoto(ctx, photoUrl, s.photoMaxBytes)
+	if err != nil {
+		return model.PhotoHash{}, err
+	}
+	img, err := imagehash.Decode(data)
+	if err != nil {
+		return model.PhotoHash{}, err
+	}
+	return model.PhotoHash{URL: photo, DHash: imagehash.DHash(img), PHash: imagehash.PHash(img)}, nil
+}
+
+// newAds returns the cars which ads are not stored yet
+func newAds(cars []model.Car, snapshots map[string]model.Car) []model.Car {
+	result := make([]model.Car, 0, len(cars))
+	for _, car := range cars {
+		if _, ok := snapshots[car.AdID]; !ok {
+			result = append(result, car)
+		}
+	}
+	return result
+}
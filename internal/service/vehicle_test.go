@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/bopoh24/bazacars/internal/config"
+	"github.com/bopoh24/bazacars/internal/model"
+	"github.com/bopoh24/bazacars/internal/repository"
+	"github.com/bopoh24/bazacars/pkg/imagehash"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// photoFetcher serves the photos drawn by their URL, the photos with "broken" in URL fail
+type photoFetcher struct{}
+
+func (photoFetcher) Fetch(_ context.Context, url string) (io.ReadCloser, error) {
+	if strings.Contains(url, "broken") {
+		return nil, errors.New("broken photo")
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testPhoto(len(url))); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// testPhoto draws the pattern of blobs which brightness depends on the seed
+func testPhoto(seed int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8((x/8*37 + y/8*91 + seed*53) % 256)
+			img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+// hashRepo stores the saved photo hashes and serves the ads without hashes
+type hashRepo struct {
+	repository.Repository
+	mu       sync.Mutex
+	unhashed []model.Car
+	hashes   map[string][]model.PhotoHash
+}
+
+func (r *hashRepo) SavePhotoHashes(_ context.Context, adID string, hashes []model.PhotoHash) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hashes[adID] = hashes
+	return nil
+}
+
+func (r *hashRepo) AdsWithoutPhotoHashes(_ context.Context, afterAdID string, limit int) ([]model.Car, error) {
+	cars := make([]model.Car, 0, limit)
+	for _, car := range r.unhashed {
+		if car.AdID > afterAdID && len(cars) < limit {
+			cars = append(cars, car)
+		}
+	}
+	return cars, nil
+}
+
+func TestHashPhotos(t *testing.T) {
+	repo := &hashRepo{hashes: make(map[string][]model.PhotoHash)}
+	s := newTestService(photoFetcher{}, repo, config.Parser{PhotoHashCount: 2, PhotoMaxBytes: 1 << 20})
+	cars := []model.Car{
+		{AdID: "1", Photos: []string{"/photos/1.jpg", "/photos/broken.jpg", "/photos/11.jpg"}},
+		{AdID: "2"},
+		{AdID: "3", Photos: []string{"/photos/3.jpg"}},
+	}
+	photoHashes := s.hashPhotos(context.Background(), cars)
+
+	assert.Len(t, photoHashes, len(cars))
+	// the broken photo is skipped, the photos after PhotoHashCount are not hashed
+	assert.Len(t, photoHashes[0], 1)
+	assert.Equal(t, 0, photoHashes[0][0].Position)
+	assert.Equal(t, "/photos/1.jpg", photoHashes[0][0].URL)
+	assert.Empty(t, photoHashes[1])
+	assert.Len(t, photoHashes[2], 1)
+
+	img := testPhoto(len(testSite + "/photos/3.jpg"))
+	assert.Equal(t, imagehash.PHash(img), photoHashes[2][0].PHash)
+	assert.Equal(t, imagehash.DHash(img), photoHashes[2][0].DHash)
+	assert.Equal(t, []uint64{photoHashes[2][0].PHash}, cars[2].PhotoHashes)
+	assert.Equal(t, photoHashes[0], repo.hashes["1"])
+	assert.Equal(t, photoHashes[2], repo.hashes["3"])
+}
+
+func TestBackfillPhotoHashes(t *testing.T) {
+	repo := &hashRepo{hashes: make(map[string][]model.PhotoHash)}
+	for i := 0; i < photoHashBackfillBatch+5; i++ {
+		adID := string(rune('a'+i/26)) + string(rune('a'+i%26))
+		// the ads which photos fail are not hashed, the backfill moves on past them
+		photo := "/photos/" + adID + ".jpg"
+		if i%10 == 0 {
+			photo = "/photos/broken.jpg"
+		}
+		repo.unhashed = append(repo.unhashed, model.Car{AdID: adID, Photos: []string{photo}})
+	}
+	s := newTestService(photoFetcher{}, repo, config.Parser{PhotoHashCount: 1, PhotoMaxBytes: 1 << 20})
+
+	processed, err := s.BackfillPhotoHashes(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, len(repo.unhashed), processed)
+	assert.Len(t, repo.hashes, len(repo.unhashed))
+	assert.Len(t, repo.hashes["ab"], 1)
+	assert.Empty(t, repo.hashes["aa"])
+}
@@ -0,0 +1,6 @@
+ALTER TABLE cars DROP COLUMN IF EXISTS doors;
+ALTER TABLE cars DROP COLUMN IF EXISTS seats;
+ALTER TABLE cars DROP COLUMN IF EXISTS body_type;
+ALTER TABLE cars DROP COLUMN IF EXISTS condition;
+ALTER TABLE cars DROP COLUMN IF EXISTS mot_till;
+ALTER TABLE cars DROP COLUMN IF EXISTS availability;
@@ -0,0 +1,6 @@
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS doors integer NOT NULL DEFAULT 0;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS seats integer NOT NULL DEFAULT 0;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS body_type text NOT NULL DEFAULT '';
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS condition text NOT NULL DEFAULT '';
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS mot_till date;
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS availability text NOT NULL DEFAULT '';
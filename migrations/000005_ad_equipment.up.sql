@@ -0,0 +1,7 @@
+create table if not exists ad_equipment (
+    ad_id text not null,
+    equipment text not null,
+    primary key (ad_id, equipment)
+);
+
+create index if not exists ad_equipment_equipment_idx on ad_equipment (equipment);
@@ -0,0 +1,6 @@
+create table if not exists ad_photos (
+    ad_id text not null,
+    position integer not null,
+    url text not null,
+    primary key (ad_id, position)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE cars DROP COLUMN IF EXISTS seller_id;
+drop table if exists sellers;
@@ -0,0 +1,10 @@
+create table if not exists sellers (
+    id serial primary key,
+    link text not null unique,
+    name text not null default '',
+    verified boolean not null default false,
+    dealer boolean not null default false,
+    updated_at timestamp not null default current_timestamp
+);
+
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS seller_id integer references sellers (id);
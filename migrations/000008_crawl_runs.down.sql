@@ -0,0 +1,2 @@
+drop table if exists crawl_run_brands;
+drop table if exists crawl_runs;
@@ -0,0 +1,22 @@
+create table if not exists crawl_runs (
+    id serial primary key,
+    mode text not null,
+    day date not null default current_date,
+    status text not null,
+    error text not null default '',
+    started_at timestamp not null default current_timestamp,
+    finished_at timestamp
+);
+
+create index if not exists crawl_runs_mode_day_idx on crawl_runs (mode, day);
+
+create table if not exists crawl_run_brands (
+    run_id integer not null references crawl_runs (id) on delete cascade,
+    brand text not null,
+    status text not null,
+    total_pages integer not null default 0,
+    last_page integer not null default 0,
+    error text not null default '',
+    updated_at timestamp not null default current_timestamp,
+    primary key (run_id, brand)
+);
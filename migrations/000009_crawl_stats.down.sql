@@ -0,0 +1,9 @@
+alter table crawl_run_brands
+    drop column if exists pages,
+    drop column if exists ads_parsed,
+    drop column if exists ads_new,
+    drop column if exists ads_updated,
+    drop column if exists ads_unchanged,
+    drop column if exists ads_failed,
+    drop column if exists forbidden,
+    drop column if exists duration_ms;
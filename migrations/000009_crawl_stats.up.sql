@@ -0,0 +1,9 @@
+alter table crawl_run_brands
+    add column if not exists pages integer not null default 0,
+    add column if not exists ads_parsed integer not null default 0,
+    add column if not exists ads_new integer not null default 0,
+    add column if not exists ads_updated integer not null default 0,
+    add column if not exists ads_unchanged integer not null default 0,
+    add column if not exists ads_failed integer not null default 0,
+    add column if not exists forbidden integer not null default 0,
+    add column if not exists duration_ms bigint not null default 0;
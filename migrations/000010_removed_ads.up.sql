@@ -0,0 +1,10 @@
+create table if not exists removed_ads (
+    ad_id text primary key,
+    listed_since date not null,
+    last_seen date not null,
+    removed_on date not null,
+    days_listed integer not null,
+    notified boolean not null default false
+);
+
+create index if not exists removed_ads_removed_on_idx on removed_ads (removed_on);
@@ -0,0 +1,3 @@
+drop index if exists cars_manufacturer_model_year_idx;
+drop table if exists ad_vehicles;
+drop table if exists vehicles;
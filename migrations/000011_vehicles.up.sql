@@ -0,0 +1,16 @@
+create table if not exists vehicles (
+    id serial primary key,
+    created_at timestamp not null default current_timestamp
+);
+
+create table if not exists ad_vehicles (
+    ad_id text primary key,
+    vehicle_id integer not null references vehicles (id) on delete cascade,
+    score real not null default 0,
+    linked_at timestamp not null default current_timestamp
+);
+
+create index if not exists ad_vehicles_vehicle_id_idx on ad_vehicles (vehicle_id);
+
+-- repost candidates lookup
+create index if not exists cars_manufacturer_model_year_idx on cars (manufacturer, model, year);
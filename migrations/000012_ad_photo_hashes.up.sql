@@ -0,0 +1,9 @@
+create table if not exists ad_photo_hashes (
+    ad_id text not null,
+    position integer not null,
+    url text not null,
+    dhash bigint not null,
+    phash bigint not null,
+    created_at timestamp not null default current_timestamp,
+    primary key (ad_id, position)
+);
@@ -0,0 +1,45 @@
+create table if not exists cars (
+    id serial primary key,
+    manufacturer text not null,
+    model text not null,
+    year integer not null,
+    mileage integer not null,
+    engine float not null,
+    fuel text not null,
+    drive text not null,
+    automatic boolean not null,
+    power integer not null,
+    color text not null,
+    price integer not null,
+    description text not null,
+    ad_id text not null,
+    address text not null default '',
+    link text not null,
+    posted timestamp not null,
+    parsed date not null default current_date,
+    sent bool not null default false,
+    doors integer not null default 0,
+    seats integer not null default 0,
+    body_type text not null default '',
+    condition text not null default '',
+    mot_till date,
+    availability text not null default '',
+    seller_id integer references sellers (id)
+);
+
+-- only the days with changes can be restored
+insert into cars (manufacturer, model, year, mileage, engine, fuel, drive, automatic, power, color, price,
+                  description, ad_id, address, link, posted, parsed, sent, doors, seats, body_type, condition,
+                  mot_till, availability, seller_id)
+select a.manufacturer, a.model, a.year, s.mileage, a.engine, a.fuel, a.drive, a.automatic, a.power, a.color,
+       s.price, s.description, a.ad_id, a.address, a.link, a.posted, s.parsed, a.sent, a.doors, a.seats,
+       a.body_type, a.condition, a.mot_till, a.availability, a.seller_id
+from ad_snapshots s
+join ads a on a.ad_id = s.ad_id;
+
+create unique index if not exists cars_ad_id_parsed_idx on cars (ad_id, parsed);
+create index if not exists cars_manufacturer_model_year_idx on cars (manufacturer, model, year);
+
+drop view if exists ads_current;
+drop table if exists ad_snapshots;
+drop table if exists ads;
@@ -0,0 +1,85 @@
+-- stable attributes of the ad
+create table if not exists ads (
+    ad_id text primary key,
+    manufacturer text not null,
+    model text not null,
+    year integer not null,
+    engine float not null,
+    fuel text not null,
+    drive text not null,
+    automatic boolean not null,
+    power integer not null,
+    color text not null,
+    doors integer not null default 0,
+    seats integer not null default 0,
+    body_type text not null default '',
+    condition text not null default '',
+    mot_till date,
+    availability text not null default '',
+    address text not null default '',
+    link text not null,
+    posted timestamp not null,
+    seller_id integer references sellers (id),
+    sent boolean not null default false,
+    first_seen date not null default current_date,
+    last_seen date not null default current_date
+);
+
+create index if not exists ads_manufacturer_model_year_idx on ads (manufacturer, model, year);
+create index if not exists ads_last_seen_idx on ads (last_seen);
+
+-- price, mileage and description, a row is added only when any of them changes
+create table if not exists ad_snapshots (
+    ad_id text not null references ads (ad_id) on delete cascade,
+    parsed date not null default current_date,
+    price integer not null,
+    mileage integer not null,
+    description text not null,
+    primary key (ad_id, parsed)
+);
+
+insert into ads (ad_id, manufacturer, model, year, engine, fuel, drive, automatic, power, color,
+                 doors, seats, body_type, condition, mot_till, availability, address, link, posted, seller_id,
+                 sent, first_seen, last_seen)
+select distinct on (c.ad_id) c.ad_id, c.manufacturer, c.model, c.year, c.engine, c.fuel, c.drive, c.automatic,
+       c.power, c.color, c.doors, c.seats, c.body_type, c.condition, c.mot_till, c.availability, c.address,
+       c.link, c.posted, c.seller_id, h.sent, h.first_seen, h.last_seen
+from cars c
+join (
+    select ad_id, bool_or(sent) as sent, min(parsed) as first_seen, max(parsed) as last_seen
+    from cars
+    group by ad_id
+) h on h.ad_id = c.ad_id
+order by c.ad_id, c.parsed desc;
+
+insert into ad_snapshots (ad_id, parsed, price, mileage, description)
+select ad_id, parsed, price, mileage, description
+from (
+    select ad_id, parsed, price, mileage, description,
+           lag(price) over w as prev_price,
+           lag(mileage) over w as prev_mileage,
+           lag(description) over w as prev_description
+    from cars
+    window w as (partition by ad_id order by parsed)
+) c
+where prev_price is null
+   or price <> prev_price
+   or mileage <> prev_mileage
+   or description <> prev_description;
+
+-- ads with the last snapshot
+create or replace view ads_current as
+select a.ad_id, a.manufacturer, a.model, a.year, a.engine, a.fuel, a.drive, a.automatic, a.power, a.color,
+       a.doors, a.seats, a.body_type, a.condition, a.mot_till, a.availability, a.address, a.link, a.posted,
+       a.seller_id, a.sent, a.first_seen, a.last_seen,
+       s.price, s.mileage, s.description, s.parsed as changed_on
+from ads a
+join lateral (
+    select price, mileage, description, parsed
+    from ad_snapshots
+    where ad_snapshots.ad_id = a.ad_id
+    order by parsed desc
+    limit 1
+) s on true;
+
+drop table if exists cars;
@@ -0,0 +1,17 @@
+drop view if exists ads_current;
+
+create view ads_current as
+select a.ad_id, a.manufacturer, a.model, a.year, a.engine, a.fuel, a.drive, a.automatic, a.power, a.color,
+       a.doors, a.seats, a.body_type, a.condition, a.mot_till, a.availability, a.address, a.link, a.posted,
+       a.seller_id, a.sent, a.first_seen, a.last_seen,
+       s.price, s.mileage, s.description, s.parsed as changed_on
+from ads a
+join lateral (
+    select price, mileage, description, parsed
+    from ad_snapshots
+    where ad_snapshots.ad_id = a.ad_id
+    order by parsed desc
+    limit 1
+) s on true;
+
+alter table ads drop column if exists notified_price;
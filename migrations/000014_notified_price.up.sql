@@ -0,0 +1,23 @@
+-- the price subscribers last know about, price changes are detected against it
+alter table ads add column if not exists notified_price integer;
+
+update ads set notified_price = c.price
+from ads_current c
+where c.ad_id = ads.ad_id;
+
+alter table ads alter column notified_price set not null;
+
+create or replace view ads_current as
+select a.ad_id, a.manufacturer, a.model, a.year, a.engine, a.fuel, a.drive, a.automatic, a.power, a.color,
+       a.doors, a.seats, a.body_type, a.condition, a.mot_till, a.availability, a.address, a.link, a.posted,
+       a.seller_id, a.sent, a.first_seen, a.last_seen,
+       s.price, s.mileage, s.description, s.parsed as changed_on,
+       a.notified_price
+from ads a
+join lateral (
+    select price, mileage, description, parsed
+    from ad_snapshots
+    where ad_snapshots.ad_id = a.ad_id
+    order by parsed desc
+    limit 1
+) s on true;
@@ -0,0 +1,43 @@
+create table if not exists subscriptions (
+    id serial primary key,
+    chat_id bigint not null references users (chat_id) on delete cascade,
+    name text not null default '',
+    brands text[] not null default '{}',
+    exclude_brands text[] not null default '{}',
+    models text[] not null default '{}',
+    exclude_models text[] not null default '{}',
+    min_price integer not null default 0,
+    max_price integer not null default 0,
+    min_year integer not null default 0,
+    max_year integer not null default 0,
+    min_mileage integer not null default 0,
+    max_mileage integer not null default 0,
+    min_engine double precision not null default 0,
+    max_engine double precision not null default 0,
+    fuels text[] not null default '{}',
+    gearbox text not null default '',
+    drives text[] not null default '{}',
+    districts text[] not null default '{}',
+    sellers text not null default 'any',
+    equipment text[] not null default '{}',
+    created_at timestamp not null default current_timestamp,
+    updated_at timestamp not null default current_timestamp
+);
+
+create index if not exists subscriptions_chat_id_idx on subscriptions (chat_id);
+
+-- the filter formerly hard-coded for everyone becomes the subscription of every approved user,
+-- the users approved later get the same one, see model.DefaultSubscription
+insert into subscriptions (chat_id, name, brands, exclude_models, max_price, min_year, max_mileage, min_engine,
+                           gearbox)
+select chat_id,
+       'Default',
+       '{BMW,Mercedes-Benz,Mazda,Toyota,Nissan,Audi,Volkswagen,Ford,Honda,Lexus,Jeep,Volvo,Infiniti,Acura,"Land Rover",Jaguar,Mini}',
+       '{Fit,2,Yaris,Aqua,Sienta,Polo,CX-3,Voxy,Porte,"Yaris Cross",C-HR,Vezel}',
+       29000,
+       2020,
+       50000,
+       1.5,
+       'automatic'
+from users
+where approved;
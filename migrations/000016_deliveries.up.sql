@@ -0,0 +1,13 @@
+-- notifications delivered to users, the global sent flag of the ad is replaced with them
+create table if not exists deliveries (
+    id bigserial primary key,
+    chat_id bigint not null references users (chat_id) on delete cascade,
+    ad_id text not null references ads (ad_id) on delete cascade,
+    event text not null,
+    status text not null,
+    error text not null default '',
+    delivered_at timestamp not null default current_timestamp
+);
+
+create index if not exists deliveries_ad_id_event_idx on deliveries (ad_id, event);
+create index if not exists deliveries_chat_id_idx on deliveries (chat_id);
@@ -0,0 +1,30 @@
+-- the recipients of the ads sent with the global flag are not known, the recent ones are assumed delivered
+-- to every approved user, so they are not sent again as new. The removal of the ad is notified only
+-- to the users whose subscription matches it, see model.DeliveryAssumed.
+insert into deliveries (chat_id, ad_id, event, status)
+select u.chat_id, a.ad_id, 'new', 'assumed'
+from ads a
+cross join users u
+where a.sent
+  and u.approved
+  and a.posted >= current_date - 1;
+
+-- columns can't be removed from the view by create or replace
+drop view if exists ads_current;
+
+alter table ads drop column if exists sent;
+
+create view ads_current as
+select a.ad_id, a.manufacturer, a.model, a.year, a.engine, a.fuel, a.drive, a.automatic, a.power, a.color,
+       a.doors, a.seats, a.body_type, a.condition, a.mot_till, a.availability, a.address, a.link, a.posted,
+       a.seller_id, a.first_seen, a.last_seen,
+       s.price, s.mileage, s.description, s.parsed as changed_on,
+       a.notified_price
+from ads a
+join lateral (
+    select price, mileage, description, parsed
+    from ad_snapshots
+    where ad_snapshots.ad_id = a.ad_id
+    order by parsed desc
+    limit 1
+) s on true;
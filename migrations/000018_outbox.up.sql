@@ -0,0 +1,18 @@
+-- notifications waiting to be delivered, the key makes enqueueing idempotent
+create table if not exists outbox (
+    id bigserial primary key,
+    key text not null unique,
+    chat_id bigint not null references users (chat_id) on delete cascade,
+    ad_id text not null references ads (ad_id) on delete cascade,
+    event text not null,
+    text text not null,
+    photos text[] not null default '{}',
+    status text not null default 'pending',
+    attempts integer not null default 0,
+    next_attempt_at timestamp not null default current_timestamp,
+    last_error text not null default '',
+    created_at timestamp not null default current_timestamp,
+    updated_at timestamp not null default current_timestamp
+);
+
+create index if not exists outbox_pending_idx on outbox (next_attempt_at) where status = 'pending';
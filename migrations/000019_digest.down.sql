@@ -0,0 +1,14 @@
+drop index if exists outbox_digest_id_idx;
+drop index if exists outbox_held_idx;
+
+-- notifications waiting for digests are sent one by one
+update outbox set status = 'pending', next_attempt_at = current_timestamp where status in ('held', 'bundled');
+alter table outbox drop column if exists digest_id;
+delete from outbox where ad_id is null;
+alter table outbox drop column if exists price_change;
+alter table outbox drop column if exists summary;
+alter table outbox drop column if exists brand;
+alter table outbox alter column ad_id set not null;
+
+alter table users drop column if exists digest_hour;
+alter table users drop column if exists delivery_mode;
@@ -0,0 +1,13 @@
+alter table users add column if not exists delivery_mode text not null default 'instant';
+alter table users add column if not exists digest_hour integer not null default 9;
+
+-- digests are not about a single ad
+alter table outbox alter column ad_id drop not null;
+alter table outbox add column if not exists brand text not null default '';
+alter table outbox add column if not exists summary text not null default '';
+alter table outbox add column if not exists price_change integer not null default 0;
+-- the digest the notification is bundled into
+alter table outbox add column if not exists digest_id bigint references outbox (id) on delete set null;
+
+create index if not exists outbox_held_idx on outbox (chat_id) where status = 'held';
+create index if not exists outbox_digest_id_idx on outbox (digest_id);
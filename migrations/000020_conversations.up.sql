@@ -0,0 +1,11 @@
+-- state of the multi-step interactions of the users with the bot
+create table if not exists conversations (
+    chat_id bigint primary key references users (chat_id) on delete cascade,
+    flow text not null,
+    step integer not null default 0,
+    data jsonb not null default '{}',
+    expires_at timestamp not null,
+    updated_at timestamp not null default current_timestamp
+);
+
+create index if not exists conversations_expires_at_idx on conversations (expires_at);
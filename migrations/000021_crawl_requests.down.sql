@@ -0,0 +1,2 @@
+alter table crawl_run_brands
+    drop column if exists requests;
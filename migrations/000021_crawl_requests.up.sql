@@ -0,0 +1,2 @@
+alter table crawl_run_brands
+    add column if not exists requests integer not null default 0;
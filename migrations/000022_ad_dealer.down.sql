@@ -0,0 +1 @@
+alter table ads drop column if exists dealer;
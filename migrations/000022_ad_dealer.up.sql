@@ -0,0 +1,6 @@
+-- the dealer flag is kept on the ad, the sellers without profile link are not stored
+alter table ads add column if not exists dealer boolean not null default false;
+
+update ads set dealer = s.dealer
+from sellers s
+where s.id = ads.seller_id;
@@ -0,0 +1,128 @@
+package imagehash
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg" // jpeg decoder
+	_ "image/png"  // png decoder
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// pHashSize is the side of the grayscale image transformed by DCT
+	pHashSize = 32
+	// hashSide is the side of the square of the hash bits
+	hashSide = 8
+)
+
+// Decode decodes the jpeg or png image
+func Decode(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// DHash returns the difference hash of the image: every bit tells whether the pixel is brighter
+// than its right neighbour in the 9x8 grayscale thumbnail
+func DHash(img image.Image) uint64 {
+	pixels := grayscale(img, hashSide+1, hashSide)
+	var hash uint64
+	for y := 0; y < hashSide; y++ {
+		for x := 0; x < hashSide; x++ {
+			hash <<= 1
+			if pixels[y*(hashSide+1)+x] > pixels[y*(hashSide+1)+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// PHash returns the perceptual hash of the image: every bit tells whether the low frequency
+// DCT coefficient of the 32x32 grayscale thumbnail is above the median
+func PHash(img image.Image) uint64 {
+	pixels := grayscale(img, pHashSize, pHashSize)
+	coeffs := dct2(pixels, pHashSize)
+
+	low := make([]float64, 0, hashSide*hashSide)
+	for y := 0; y < hashSide; y++ {
+		low = append(low, coeffs[y*pHashSize:y*pHashSize+hashSide]...)
+	}
+	// the DC coefficient is the average brightness, it is not used for the median
+	sorted := append([]float64(nil), low[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, coeff := range low {
+		hash <<= 1
+		if coeff > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of different bits of the hashes
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// grayscale returns the luminance of the image scaled down to w x h by averaging the pixels of each cell
+func grayscale(img image.Image, w, h int) []float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	sums := make([]float64, w*h)
+	counts := make([]int, w*h)
+	if width == 0 || height == 0 {
+		return sums
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		cy := (y - bounds.Min.Y) * h / height
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cx := (x - bounds.Min.X) * w / width
+			r, g, b, _ := img.At(x, y).RGBA()
+			sums[cy*w+cx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			counts[cy*w+cx]++
+		}
+	}
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= float64(counts[i])
+		}
+	}
+	return sums
+}
+
+// dct2 returns the two-dimensional DCT-II of the n x n matrix
+func dct2(pixels []float64, n int) []float64 {
+	cos := make([]float64, n*n)
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			cos[k*n+i] = math.Cos(math.Pi / float64(n) * (float64(i) + 0.5) * float64(k))
+		}
+	}
+	// rows then columns
+	rows := make([]float64, n*n)
+	for y := 0; y < n; y++ {
+		for k := 0; k < n; k++ {
+			var sum float64
+			for i := 0; i < n; i++ {
+				sum += pixels[y*n+i] * cos[k*n+i]
+			}
+			rows[y*n+k] = sum
+		}
+	}
+	result := make([]float64, n*n)
+	for x := 0; x < n; x++ {
+		for k := 0; k < n; k++ {
+			var sum float64
+			for i := 0; i < n; i++ {
+				sum += rows[i*n+x] * cos[k*n+i]
+			}
+			result[k*n+x] = sum
+		}
+	}
+	return result
+}
@@ -0,0 +1,57 @@
+package imagehash
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage draws the pattern of blobs which brightness depends on the seed
+func testImage(w, h int, seed int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			cx, cy := x*8/w, y*8/h
+			v := uint8((cx*37 + cy*91 + seed*53) % 256)
+			img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestHashes(t *testing.T) {
+	original := testImage(400, 300, 1)
+
+	// the same photo resized and recompressed
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, testImage(800, 600, 1), &jpeg.Options{Quality: 60}))
+	resized, err := Decode(buf.Bytes())
+	assert.NoError(t, err)
+
+	other := testImage(400, 300, 2)
+
+	for name, hash := range map[string]func(image.Image) uint64{"dhash": DHash, "phash": PHash} {
+		assert.LessOrEqual(t, Distance(hash(original), hash(resized)), 4, name)
+		assert.Greater(t, Distance(hash(original), hash(other)), 10, name)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, testImage(16, 16, 1)))
+	img, err := Decode(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 16, 16), img.Bounds())
+
+	_, err = Decode([]byte("not an image"))
+	assert.Error(t, err)
+}
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 0, Distance(0xFF, 0xFF))
+	assert.Equal(t, 64, Distance(0, ^uint64(0)))
+}
@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	bucket := NewTokenBucket(100, 2)
+	started := time.Now()
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, bucket.Wait(context.Background()))
+	}
+	// two tokens from burst and five more at 100 per second
+	assert.GreaterOrEqual(t, time.Since(started), 45*time.Millisecond)
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	bucket := NewTokenBucket(1, 1)
+	assert.NoError(t, bucket.Wait(context.Background()))
+	bucket.SetRate(1000)
+	assert.Equal(t, 1000.0, bucket.Rate())
+	started := time.Now()
+	assert.NoError(t, bucket.Wait(context.Background()))
+	assert.Less(t, time.Since(started), 100*time.Millisecond)
+}
+
+func TestTokenBucketContextCancel(t *testing.T) {
+	bucket := NewTokenBucket(0.1, 1)
+	assert.NoError(t, bucket.Wait(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, bucket.Wait(ctx), context.DeadlineExceeded)
+}